@@ -14,3 +14,10 @@ log-info "building api service"
 docker build --target api-service -t api-service .
 docker tag api-service:latest api-service:latest-local
 
+log-info "building products service"
+docker build --target products-service -t products-service .
+docker tag products-service:latest products-service:latest-local
+
+log-info "building rotator"
+docker build --target rotator -t rotator .
+docker tag rotator:latest rotator:latest-local
@@ -26,7 +26,7 @@ pull-images() {
 }
 
 # Load builded images
-container_images=("spiffe-helper:latest-local" "client-service:latest-local" "api-service:latest-local")
+container_images=("spiffe-helper:latest-local" "client-service:latest-local" "api-service:latest-local" "products-service:latest-local" "rotator:latest-local")
 load-images ${CLUSTER_NAME} "${container_images[@]}"
 
 # Load SPIRE images, to avoid downloading them from the internet
@@ -1,15 +1,8 @@
 #!/bin/bash
 
-. common.sh
-
-podName=$(${KUBECTL_PATH} get pod -n spire-system -l app=spire-server -o jsonpath="{.items[0].metadata.name}")
-
-old_authority=$(${KUBECTL_PATH} exec -n spire-system $podName -- ./bin/spire-server localauthority x509 show -output json | jq -r .old.authority_id)
+set -eu
 
-log-info "revoke authority: $old_authority"
-${KUBECTL_PATH} exec -n spire-system $podName -- ./bin/spire-server localauthority x509 revoke -authorityID $old_authority
-
-sleep 5
+. common.sh
 
-log-info "Bundle in pem format"
-${KUBECTL_PATH} exec -n spire-system $podName -- ./bin/spire-server bundle show
+log-info "Verifying workloads and revoking old X509 authority"
+rotator -type x509 -workloads "$WORKLOADS" revoke
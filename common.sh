@@ -38,3 +38,16 @@ fail-now() {
     exit 1
 }
 
+
+# Status endpoints of the workloads that must use the active authority before
+# the old one is revoked. Hosts are headless Services, the rotator resolves
+# them on every check and verifies each pod. Add the Service of a new workload
+# here, otherwise authorities are revoked without waiting for it.
+WORKLOADS="http://api-admin.api-ns.svc.cluster.local:9002/status/authority,http://products-admin.products-ns.svc.cluster.local:9004/status/authority,http://client-admin.client-ns.svc.cluster.local:8081/status/authority"
+
+# Runs the rotator, from the sidecar of the SPIRE server pod, with the provided arguments
+rotator() {
+    local podName
+    podName=$(${KUBECTL_PATH} get pod -n spire-system -l app=spire-server -o jsonpath="{.items[0].metadata.name}")
+    ${KUBECTL_PATH} exec -n spire-system $podName -c rotator -- /opt/rotator/rotator "$@"
+}
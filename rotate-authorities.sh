@@ -0,0 +1,11 @@
+#!/bin/bash
+
+set -eu
+
+. common.sh
+
+# Runs the full prepare, activate, taint and revoke sequence, for X509 and JWT
+# authorities. Old authorities are only revoked once every workload uses the
+# new ones. Extra flags are forwarded, e.g. -taintWait 1m
+log-info "Rotating X509 and JWT authorities"
+rotator -type all -workloads "$WORKLOADS" "$@" rotate
@@ -2,79 +2,137 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"rotation"
+	"rotation/service"
+	"slices"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 type authenticator struct {
-	// JWT Source used to verify token
+	// JWT Source used to fetch the service JWT-SVID, only used for logging
+	// and may be nil
 	jwtSource *workloadapi.JWTSource
+	// Bundles used to verify tokens, by issuing trust domain
+	bundles jwtbundle.Source
+	// Trust domain of the service
+	trustDomain spiffeid.TrustDomain
 	// Expected audiences
 	audiences []string
+	// Counts token validations by result
+	validations *prometheus.CounterVec
+	// When true the token subject must be the mTLS peer
+	bindPeer bool
+	// Peers allowed to present tokens issued to other workloads
+	delegates []spiffeid.ID
 	log       *slog.Logger
 }
 
+// peerBindingConfig requires JWT-SVIDs to be presented by the workload they
+// were issued to
+type peerBindingConfig struct {
+	// SPIFFE IDs allowed to forward JWT-SVIDs of other workloads
+	Delegates []string `hcl:"delegates,optional"`
+}
+
+func parseDelegates(c *peerBindingConfig) ([]spiffeid.ID, error) {
+	var delegates []spiffeid.ID
+	for _, rawID := range c.Delegates {
+		id, err := spiffeid.FromString(rawID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delegate %q: %w", rawID, err)
+		}
+		delegates = append(delegates, id)
+	}
+	return delegates, nil
+}
+
 func (a *authenticator) authenticateClient(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		fields := strings.Fields(req.Header.Get("Authorization"))
 		if len(fields) != 2 || fields[0] != "Bearer" {
 			a.log.Error("Malformed header")
-			http.Error(w, "Invalid or unsupported authorization header", http.StatusUnauthorized)
+			a.validations.WithLabelValues("failure").Inc()
+			service.WriteError(w, http.StatusUnauthorized, service.CodeUnauthenticated, "missing or unsupported authorization header, a bearer JWT-SVID is required")
 			return
 		}
 
 		token := fields[1]
 
-		displayJWT(req.Context(), a.jwtSource, a.log)
+		a.displayJWT(req.Context())
 
-		// Parse and validate token against fetched bundle from jwtSource,
+		// Parse and validate token against the bundle of its trust domain,
 		// an alternative is using `workloadapi.ValidateJWTSVID` that will
 		// attest against SPIRE on each call and validate token
-		svid, err := jwtsvid.ParseAndValidate(token, a.jwtSource, a.audiences)
+		svid, err := jwtsvid.ParseAndValidate(token, a.bundles, a.audiences)
 		if err != nil {
-			fmt.Printf("Failed to parse and validate token: %v", err)
 			a.log.Error("Invalid token", "error", err)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			a.validations.WithLabelValues("failure").Inc()
+			service.WriteError(w, http.StatusUnauthorized, service.CodeUnauthenticated, "JWT-SVID is not valid")
 			return
 		}
-		req = req.WithContext(withSVIDClaims(req.Context(), svid.Claims))
+		if a.bindPeer {
+			// The token is valid, but the peer is not allowed to present it
+			if err := a.checkPeerBinding(req, svid); err != nil {
+				a.log.Error("Token not bound to peer", "sub", svid.ID.String(), "error", err)
+				a.validations.WithLabelValues("failure").Inc()
+				service.WriteError(w, http.StatusForbidden, service.CodeForbidden, "JWT-SVID was not issued to the mTLS peer")
+				return
+			}
+		}
+		a.log.Debug("Token validated", "sub", svid.ID.String(), "trust_domain", svid.ID.TrustDomain())
+		a.validations.WithLabelValues("success").Inc()
+		req = req.WithContext(service.WithSVIDClaims(req.Context(), svid.Claims))
 		next.ServeHTTP(w, req)
 	})
 }
 
-type svidClaimsKey struct{}
-
-func withSVIDClaims(ctx context.Context, claims map[string]interface{}) context.Context {
-	return context.WithValue(ctx, svidClaimsKey{}, claims)
-}
+// checkPeerBinding verifies the token was issued to the mTLS peer, or that
+// the peer is allowed to present tokens on behalf of other workloads
+func (a *authenticator) checkPeerBinding(req *http.Request, svid *jwtsvid.SVID) error {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	peerID, err := x509svid.IDFromCert(req.TLS.PeerCertificates[0])
+	if err != nil {
+		return fmt.Errorf("failed to get peer SPIFFE ID: %w", err)
+	}
 
-func svidClaims(ctx context.Context) map[string]interface{} {
-	claims, _ := ctx.Value(svidClaimsKey{}).(map[string]interface{})
-	return claims
+	if svid.ID == peerID || slices.Contains(a.delegates, peerID) {
+		return nil
+	}
+	return fmt.Errorf("token subject %q does not match peer %q", svid.ID, peerID)
 }
 
-func displayJWT(ctx context.Context, jwtSource *workloadapi.JWTSource, log *slog.Logger) {
-	jwtBundle, err := jwtSource.GetJWTBundleForTrustDomain(spiffeid.RequireTrustDomainFromString("cluster.demo"))
+func (a *authenticator) displayJWT(ctx context.Context) {
+	if a.jwtSource == nil {
+		return
+	}
+	jwtBundle, err := a.jwtSource.GetJWTBundleForTrustDomain(a.trustDomain)
 	if err != nil {
-		log.Error("Failed to get JWT bundle", "error", err)
+		a.log.Error("Failed to get JWT bundle", "error", err)
 		return
 	}
 
 	for skid := range jwtBundle.JWTAuthorities() {
-		log.Info("JWT authority found", "key_id", skid)
+		a.log.Info("JWT authority found", "key_id", skid)
 	}
 
-	jwtSVID, err := jwtSource.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "aud"})
+	jwtSVID, err := a.jwtSource.FetchJWTSVID(ctx, jwtsvid.Params{Audience: a.audiences[0]})
 	if err != nil {
-		log.Error("Failed to fetch JWT SVID", "error", err)
+		a.log.Error("Failed to fetch JWT SVID", "error", err)
 		return
 	}
-	log.Info("JWT SVID fetched", "marshal", jwtSVID.Marshal())
-
+	keyID, _ := rotation.JWTKeyID(jwtSVID.Marshal())
+	a.log.Info("JWT SVID fetched", "key_id", keyID, "expiry", jwtSVID.Expiry)
 }
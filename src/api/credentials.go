@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// dataDirName is the symlink that points to the versioned directory
+	// holding the current set of credentials
+	dataDirName = "..data"
+	// versionDirPrefix is used to name every staged credentials directory
+	versionDirPrefix = "..svid_"
+)
+
+// credentialsConfig configures where and how SVID material is written
+type credentialsConfig struct {
+	// Directory where files are written, it is created if it does not exist
+	Dir string `hcl:"dir,optional"`
+	// File names, relative to Dir
+	SVIDFileName   string `hcl:"svid_file_name,optional"`
+	KeyFileName    string `hcl:"svid_key_file_name,optional"`
+	BundleFileName string `hcl:"svid_bundle_file_name,optional"`
+	// Octal permissions, e.g. "0644"
+	CertFileMode string `hcl:"cert_file_mode,optional"`
+	KeyFileMode  string `hcl:"key_file_mode,optional"`
+	// Optional owner for written files
+	UID *int `hcl:"uid,optional"`
+	GID *int `hcl:"gid,optional"`
+
+	certMode os.FileMode
+	keyMode  os.FileMode
+}
+
+// setDefaults fills unset values with the ones used before the
+// credentials block was configurable
+func (c *credentialsConfig) setDefaults() {
+	if c.Dir == "" {
+		c.Dir = "."
+	}
+	if c.SVIDFileName == "" {
+		c.SVIDFileName = "svid.pem"
+	}
+	if c.KeyFileName == "" {
+		c.KeyFileName = "svid.key"
+	}
+	if c.BundleFileName == "" {
+		c.BundleFileName = "bundle.pem"
+	}
+	if c.CertFileMode == "" {
+		c.CertFileMode = "0644"
+	}
+	if c.KeyFileMode == "" {
+		c.KeyFileMode = "0600"
+	}
+}
+
+func (c *credentialsConfig) validate() error {
+	names := []string{c.SVIDFileName, c.KeyFileName, c.BundleFileName}
+	for i, name := range names {
+		if name != filepath.Base(name) || name == "." || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("file name %q must be a plain file name", name)
+		}
+		if slices.Contains(names[:i], name) {
+			return fmt.Errorf("file name %q is used more than once", name)
+		}
+	}
+
+	var err error
+	if c.certMode, err = parseFileMode(c.CertFileMode); err != nil {
+		return fmt.Errorf("invalid cert_file_mode: %w", err)
+	}
+	if c.keyMode, err = parseFileMode(c.KeyFileMode); err != nil {
+		return fmt.Errorf("invalid key_file_mode: %w", err)
+	}
+	// Same limit lib/pq enforces when loading the key
+	if c.keyMode&0137 != 0 {
+		return fmt.Errorf("key_file_mode %q must be 0640 or less", c.KeyFileMode)
+	}
+
+	if c.UID != nil && *c.UID < 0 {
+		return fmt.Errorf("uid must be non-negative, got %d", *c.UID)
+	}
+	if c.GID != nil && *c.GID < 0 {
+		return fmt.Errorf("gid must be non-negative, got %d", *c.GID)
+	}
+
+	return nil
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an octal file mode", s)
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("%q contains bits other than permissions", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// credentialFile is a single file written by the credentialWriter
+type credentialFile struct {
+	name string
+	data []byte
+	mode os.FileMode
+}
+
+// credentialWriter stores SVID, key and bundle on disk so they can be
+// replaced as a unit. Every update is staged in a new versioned directory,
+// synced, and then published by atomically renaming the "..data" symlink to
+// point to it. The stable names in the directory (e.g. svid.pem) are
+// symlinks into "..data". Each open of a stable name resolves "..data"
+// again, so the database, which loads the certificate and its key, takes
+// both from a single version through use, see fileConnector.
+type credentialWriter struct {
+	dir    string
+	config *credentialsConfig
+
+	mu sync.Mutex
+	// versions is held for writing while old versions are removed, and for
+	// reading while a version is in use
+	versions sync.RWMutex
+}
+
+// newCredentialWriter creates a writer, config must be already validated
+func newCredentialWriter(config *credentialsConfig) *credentialWriter {
+	return &credentialWriter{
+		dir:    config.Dir,
+		config: config,
+	}
+}
+
+// writeSVID stores SVID, key and bundle using configured names and permissions
+func (w *credentialWriter) writeSVID(cert, key, bundle []byte) error {
+	return w.write(
+		credentialFile{name: w.config.SVIDFileName, data: cert, mode: w.config.certMode},
+		credentialFile{name: w.config.KeyFileName, data: key, mode: w.config.keyMode},
+		credentialFile{name: w.config.BundleFileName, data: bundle, mode: w.config.certMode},
+	)
+}
+
+// write stages files in a new versioned directory and swaps it in
+func (w *credentialWriter) write(files ...credentialFile) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create credentials directory: %w", err)
+	}
+
+	versionDir, err := os.MkdirTemp(w.dir, versionDirPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	// MkdirTemp creates directories with 0700, consumers running as other
+	// users still need to traverse it
+	if err := os.Chmod(versionDir, 0755); err != nil { // nolint: gosec // files keep their own permissions
+		return w.abort(versionDir, fmt.Errorf("failed to set staging directory permissions: %w", err))
+	}
+	if err := w.chown(versionDir, os.Chown); err != nil {
+		return w.abort(versionDir, err)
+	}
+
+	for _, f := range files {
+		path := filepath.Join(versionDir, f.name)
+		if err := writeFileSync(path, f.data, f.mode); err != nil {
+			return w.abort(versionDir, err)
+		}
+		if err := w.chown(path, os.Chown); err != nil {
+			return w.abort(versionDir, err)
+		}
+	}
+	if err := syncDir(versionDir); err != nil {
+		return w.abort(versionDir, err)
+	}
+
+	previous, _ := os.Readlink(filepath.Join(w.dir, dataDirName))
+
+	// Flip "..data" to the new version, rename is atomic so readers see
+	// either the old or the new directory, never a mix of both
+	tmpLink := filepath.Join(w.dir, dataDirName+"_tmp")
+	_ = os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(versionDir), tmpLink); err != nil {
+		return w.abort(versionDir, fmt.Errorf("failed to create data symlink: %w", err))
+	}
+	if err := os.Rename(tmpLink, filepath.Join(w.dir, dataDirName)); err != nil {
+		_ = os.Remove(tmpLink)
+		return w.abort(versionDir, fmt.Errorf("failed to publish credentials: %w", err))
+	}
+
+	for _, f := range files {
+		if err := w.linkFile(f.name); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	// Keep the previous version around, a reader may have resolved "..data"
+	// right before the flip and still be opening files from it
+	return w.prune(filepath.Base(versionDir), previous)
+}
+
+// credentialPaths are the files of a single credentials version
+type credentialPaths struct {
+	SVID   string
+	Key    string
+	Bundle string
+}
+
+// use calls fn with the files of the current version, the version is not
+// removed until fn returns
+func (w *credentialWriter) use(fn func(paths *credentialPaths) error) error {
+	w.versions.RLock()
+	defer w.versions.RUnlock()
+
+	paths, err := w.current()
+	if err != nil {
+		return err
+	}
+	return fn(paths)
+}
+
+// current resolves "..data" once and returns the paths of the files inside
+// the version it points to. The previous version is kept on every write, so
+// the paths stay valid until two more updates are published.
+func (w *credentialWriter) current() (*credentialPaths, error) {
+	version, err := os.Readlink(filepath.Join(w.dir, dataDirName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve current credentials: %w", err)
+	}
+
+	versionDir := filepath.Join(w.dir, version)
+	return &credentialPaths{
+		SVID:   filepath.Join(versionDir, w.config.SVIDFileName),
+		Key:    filepath.Join(versionDir, w.config.KeyFileName),
+		Bundle: filepath.Join(versionDir, w.config.BundleFileName),
+	}, nil
+}
+
+// linkFile makes sure dir/name is a symlink to "..data/name". Plain files
+// left by older versions are replaced atomically.
+func (w *credentialWriter) linkFile(name string) error {
+	path := filepath.Join(w.dir, name)
+	target := filepath.Join(dataDirName, name)
+
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+
+	tmpLink := path + ".tmp"
+	_ = os.Remove(tmpLink)
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return fmt.Errorf("failed to create symlink for %q: %w", name, err)
+	}
+	if err := w.chown(tmpLink, os.Lchown); err != nil {
+		_ = os.Remove(tmpLink)
+		return err
+	}
+	if err := os.Rename(tmpLink, path); err != nil {
+		_ = os.Remove(tmpLink)
+		return fmt.Errorf("failed to publish symlink for %q: %w", name, err)
+	}
+	return nil
+}
+
+// prune removes every versioned directory except the current and previous
+// ones, it waits for versions in use
+func (w *credentialWriter) prune(keep ...string) error {
+	w.versions.Lock()
+	defer w.versions.Unlock()
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list credentials directory: %w", err)
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, versionDirPrefix) || slices.Contains(keep, name) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(w.dir, name)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove old credentials %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// chown sets the configured owner on path, it is a no-op when no owner is configured
+func (w *credentialWriter) chown(path string, chownFn func(string, int, int) error) error {
+	uid, gid := -1, -1
+	if w.config.UID != nil {
+		uid = *w.config.UID
+	}
+	if w.config.GID != nil {
+		gid = *w.config.GID
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+
+	if err := chownFn(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set owner of %q: %w", path, err)
+	}
+	return nil
+}
+
+func (w *credentialWriter) abort(versionDir string, err error) error {
+	if rmErr := os.RemoveAll(versionDir); rmErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to clean staging directory: %w", rmErr))
+	}
+	return err
+}
+
+func writeFileSync(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", path, err)
+	}
+	// The mode given to OpenFile is reduced by the umask
+	if err := os.Chmod(path, mode); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to set permissions of %q: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %q: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %q: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %q: %w", path, err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %q: %w", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %q: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testKeyPair returns a self-signed certificate and its key, PEM encoded
+func testKeyPair(t *testing.T, serial int64) (cert, key []byte) {
+	t.Helper()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "svid"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func newTestCredentialWriter(t *testing.T) *credentialWriter {
+	t.Helper()
+	config := &credentialsConfig{Dir: t.TempDir()}
+	config.setDefaults()
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return newCredentialWriter(config)
+}
+
+// TestCredentialWriterConcurrentRotations opens database connections, that
+// load the certificate and key from the written files, while they are
+// rotated. lib/pq fails to connect when the certificate does not match its
+// key.
+func TestCredentialWriterConcurrentRotations(t *testing.T) {
+	const (
+		pairs     = 4
+		rotations = 100
+		readers   = 8
+	)
+
+	server := newFakePostgres(t)
+	w := newTestCredentialWriter(t)
+	var certs, keys [pairs][]byte
+	for i := range pairs {
+		certs[i], keys[i] = testKeyPair(t, int64(i+1))
+	}
+	// The bundle verifies the server certificate
+	if err := w.writeSVID(certs[0], keys[0], server.certPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newDatabase(&fileConnector{connStr: server.connStr(), writer: w}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer db.Close()
+
+	var done atomic.Bool
+	var connects atomic.Int64
+	var wg sync.WaitGroup
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				err := db.do(func(pool *sql.DB) error {
+					conn, err := pool.Conn(context.Background())
+					if err != nil {
+						return err
+					}
+					// Discard the connection so the next one loads the files again
+					_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+					return nil
+				})
+				if err != nil {
+					t.Errorf("failed to connect: %v", err)
+					return
+				}
+				connects.Add(1)
+			}
+		}()
+	}
+
+	// The pool is not recycled, so connections are opened while every
+	// rotation is written
+	for i := range rotations {
+		next := (i + 1) % pairs
+		if err := w.writeSVID(certs[next], keys[next], server.certPEM); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	for _, conn := range server.connections() {
+		if serial, err := strconv.Atoi(conn.serial); err != nil || serial < 1 || serial > pairs {
+			t.Fatalf("connection presented unexpected SVID %s", conn.serial)
+		}
+	}
+	t.Logf("%d connections during %d rotations", connects.Load(), rotations)
+}
+
+func TestCredentialWriterLayout(t *testing.T) {
+	w := newTestCredentialWriter(t)
+
+	for i := range 3 {
+		cert, key := testKeyPair(t, int64(i+1))
+		if err := w.writeSVID(cert, key, cert); err != nil {
+			t.Fatal(err)
+		}
+
+		paths, err := w.current()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(paths.SVID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(cert) {
+			t.Fatalf("write %d: current SVID is not the last one written", i)
+		}
+		// Stable names point to the current version
+		stable, err := os.ReadFile(filepath.Join(w.dir, "svid.key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stable) != string(key) {
+			t.Fatalf("write %d: svid.key is not the last key written", i)
+		}
+	}
+
+	// Only the current and previous versions are kept
+	versions, err := filepath.Glob(filepath.Join(w.dir, versionDirPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("found %d versions, want 2", len(versions))
+	}
+
+	info, err := os.Stat(filepath.Join(w.dir, "svid.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("key mode = %o, want 600", mode)
+	}
+}
+
+// TestCredentialWriterModes verifies configured modes are applied as they
+// are, without the umask
+func TestCredentialWriterModes(t *testing.T) {
+	oldMask := syscall.Umask(0077)
+	defer syscall.Umask(oldMask)
+
+	config := &credentialsConfig{Dir: t.TempDir(), CertFileMode: "0664", KeyFileMode: "0640"}
+	config.setDefaults()
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	w := newCredentialWriter(config)
+	cert, key := testKeyPair(t, 1)
+	if err := w.writeSVID(cert, key, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]os.FileMode{"svid.pem": 0664, "svid.key": 0640, "bundle.pem": 0664} {
+		info, err := os.Stat(filepath.Join(w.dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != want {
+			t.Errorf("%s mode = %o, want %o", name, mode, want)
+		}
+	}
+}
+
+func TestCredentialsConfigValidate(t *testing.T) {
+	id := func(v int) *int { return &v }
+
+	tests := []struct {
+		name    string
+		config  credentialsConfig
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "root owner", config: credentialsConfig{UID: id(0), GID: id(0)}},
+		{name: "negative uid", config: credentialsConfig{UID: id(-1)}, wantErr: "uid must be non-negative, got -1"},
+		{name: "negative gid", config: credentialsConfig{GID: id(-1)}, wantErr: "gid must be non-negative, got -1"},
+		{name: "key readable by others", config: credentialsConfig{KeyFileMode: "0644"}, wantErr: `key_file_mode "0644" must be 0640 or less`},
+		{name: "invalid mode", config: credentialsConfig{CertFileMode: "rw"}, wantErr: `invalid cert_file_mode: "rw" is not an octal file mode`},
+		{name: "path as file name", config: credentialsConfig{SVIDFileName: "../svid.pem"}, wantErr: `file name "../svid.pem" must be a plain file name`},
+		{name: "repeated file name", config: credentialsConfig{KeyFileName: "svid.pem"}, wantErr: `file name "svid.pem" is used more than once`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.setDefaults()
+			err := tt.config.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
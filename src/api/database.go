@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sslRequestCode is the Postgres protocol code used to ask the server to
+// start a TLS handshake
+const sslRequestCode = 80877103
+
+// postgresDialer opens connections to Postgres and negotiates TLS itself,
+// so certificates are taken from memory instead of files. lib/pq must be
+// configured with "sslmode=disable" since it receives an already secured
+// connection.
+type postgresDialer struct {
+	tlsConfig *tls.Config
+	dialer    net.Dialer
+}
+
+func (d *postgresDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *postgresDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *postgresDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// SSLRequest message: length followed by the request code
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], sslRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to request TLS: %w", err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read TLS response: %w", err)
+	}
+	if response[0] != 'S' {
+		conn.Close()
+		return nil, fmt.Errorf("server does not support TLS")
+	}
+
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// tlsConnector secures connections with tlsConfig, connStr must set
+// "sslmode=disable"
+func tlsConnector(connStr string, tlsConfig *tls.Config) (driver.Connector, error) {
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+	connector.Dialer(&postgresDialer{tlsConfig: tlsConfig})
+	return connector, nil
+}
+
+// fileConnector lets lib/pq load the SVID, key and bundle written by
+// writer. lib/pq opens every file on each connection, and the stable names
+// could resolve to different versions if a rotation happened in between, so
+// each connection is given the files of a single version instead.
+type fileConnector struct {
+	connStr string
+	writer  *credentialWriter
+}
+
+func (c *fileConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	err := c.writer.use(func(paths *credentialPaths) error {
+		connector, err := pq.NewConnector(fmt.Sprintf("%s sslcert=%s sslkey=%s sslrootcert=%s", c.connStr,
+			connStrValue(paths.SVID), connStrValue(paths.Key), connStrValue(paths.Bundle)))
+		if err != nil {
+			return fmt.Errorf("invalid connection string: %w", err)
+		}
+		conn, err = connector.Connect(ctx)
+		return err
+	})
+	return conn, err
+}
+
+func (c *fileConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// connStrValue quotes v as a connection string value
+func connStrValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(v) + "'"
+}
+
+// database is a long-lived connection pool that is replaced every time the
+// SVID rotates, so no connection outlives the certificate it was opened with
+type database struct {
+	connector driver.Connector
+	log       *slog.Logger
+
+	mu sync.RWMutex
+	db *sql.DB
+}
+
+// newDatabase creates a pool opening connections with connector
+func newDatabase(connector driver.Connector, log *slog.Logger) *database {
+	return &database{
+		connector: connector,
+		log:       log,
+		db:        sql.OpenDB(connector),
+	}
+}
+
+// do calls fn with the current pool, a rotation waits until fn returns
+func (d *database) do(fn func(db *sql.DB) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return fn(d.db)
+}
+
+// conn returns a connection of the current pool, a rotation does not wait
+// for it to be closed. It is meant for sessions that would block rotations if
+// run within do, the connection keeps the SVID it was opened with until it is
+// closed.
+func (d *database) conn(ctx context.Context) (*sql.Conn, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.db.Conn(ctx)
+}
+
+// rotate replaces the pool, it waits for in-flight calls to finish and then
+// closes every connection opened with the previous SVID
+func (d *database) rotate() {
+	d.mu.Lock()
+	old := d.db
+	d.db = sql.OpenDB(d.connector)
+	d.mu.Unlock()
+
+	stats := old.Stats()
+	if err := old.Close(); err != nil {
+		d.log.Error("Failed to close database connections", "error", err)
+		return
+	}
+	d.log.Info("Database connections recycled", "closed", stats.OpenConnections)
+}
+
+// Close closes the current pool
+func (d *database) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.db.Close()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePostgres accepts TLS connections the way Postgres does and completes
+// the startup without authentication. It records the client certificate of
+// every connection and when the client closes it.
+type fakePostgres struct {
+	t         *testing.T
+	listener  net.Listener
+	tlsConfig *tls.Config
+	// certPEM is the server certificate, it is self-signed
+	certPEM []byte
+
+	mu    sync.Mutex
+	conns []*fakeConn
+}
+
+type fakeConn struct {
+	serial string
+	closed chan struct{}
+}
+
+func newFakePostgres(t *testing.T) *fakePostgres {
+	cert, key := testKeyPair(t, 1000)
+	serverCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	p := &fakePostgres{
+		t:        t,
+		listener: listener,
+		certPEM:  cert,
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAnyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	go p.serve()
+	return p
+}
+
+func (p *fakePostgres) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *fakePostgres) handle(conn net.Conn) {
+	defer conn.Close()
+
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(request[4:8]) != sslRequestCode {
+		p.t.Errorf("expected SSLRequest, got code %d", binary.BigEndian.Uint32(request[4:8]))
+		return
+	}
+	if _, err := conn.Write([]byte{'S'}); err != nil {
+		return
+	}
+
+	tlsConn := tls.Server(conn, p.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		p.t.Errorf("TLS handshake failed: %v", err)
+		return
+	}
+	fc := &fakeConn{
+		serial: tlsConn.ConnectionState().PeerCertificates[0].SerialNumber.String(),
+		closed: make(chan struct{}),
+	}
+	defer close(fc.closed)
+
+	// Startup message: length, including itself, followed by parameters
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(tlsConn, header); err != nil {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, tlsConn, int64(binary.BigEndian.Uint32(header)-4)); err != nil {
+		return
+	}
+	// AuthenticationOk and ReadyForQuery
+	if _, err := tlsConn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 0, 'Z', 0, 0, 0, 5, 'I'}); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.conns = append(p.conns, fc)
+	p.mu.Unlock()
+
+	// Wait for the client to terminate the connection
+	_, _ = io.Copy(io.Discard, tlsConn)
+}
+
+func (p *fakePostgres) connections() []*fakeConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*fakeConn(nil), p.conns...)
+}
+
+func (p *fakePostgres) connStr() string {
+	addr := p.listener.Addr().(*net.TCPAddr)
+	return "host=127.0.0.1 port=" + strconv.Itoa(addr.Port) + " user=symuser dbname=demodb"
+}
+
+// TestDatabaseRotate verifies rotate closes every connection opened with
+// the previous SVID and that new connections present the current one
+func TestDatabaseRotate(t *testing.T) {
+	const poolSize = 3
+
+	server := newFakePostgres(t)
+
+	var current atomic.Pointer[tls.Certificate]
+	setSVID := func(serial int64) {
+		certPEM, keyPEM := testKeyPair(t, serial)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current.Store(&cert)
+	}
+	setSVID(1)
+
+	// The SVID is taken from memory on every handshake, as with the X509Source
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, // nolint: gosec // the fake server certificate is not verified
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		},
+	}
+	connector, err := tlsConnector(server.connStr()+" sslmode=disable", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newDatabase(connector, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	openConns := func(n int) {
+		t.Helper()
+		err := db.do(func(pool *sql.DB) error {
+			var conns []io.Closer
+			defer func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}()
+			for range n {
+				conn, err := pool.Conn(ctx)
+				if err != nil {
+					return err
+				}
+				conns = append(conns, conn)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to open connections: %v", err)
+		}
+	}
+
+	openConns(poolSize)
+	before := server.connections()
+	if len(before) != poolSize {
+		t.Fatalf("server accepted %d connections, want %d", len(before), poolSize)
+	}
+	for _, conn := range before {
+		if conn.serial != "1" {
+			t.Fatalf("connection presented SVID %s, want 1", conn.serial)
+		}
+	}
+
+	setSVID(2)
+	db.rotate()
+
+	for i, conn := range before {
+		select {
+		case <-conn.closed:
+		case <-ctx.Done():
+			t.Fatalf("connection %d opened before rotation is still open", i)
+		}
+	}
+
+	openConns(1)
+	after := server.connections()[len(before):]
+	if len(after) != 1 {
+		t.Fatalf("server accepted %d connections after rotation, want 1", len(after))
+	}
+	if after[0].serial != "2" {
+		t.Fatalf("connection opened after rotation presented SVID %s, want 2", after[0].serial)
+	}
+}
+
+func TestPostgresDialerRequiresTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.ReadFull(conn, make([]byte, 8))
+		// Servers without TLS answer 'N'
+		_, _ = conn.Write([]byte{'N'})
+	}()
+
+	d := &postgresDialer{tlsConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	_, err = d.DialTimeout("tcp", listener.Addr().String(), 5*time.Second)
+	if err == nil || err.Error() != "server does not support TLS" {
+		t.Fatalf("error = %v, want server does not support TLS", err)
+	}
+}
@@ -1,119 +1,245 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"rotation/service"
+	"strconv"
 
-	_ "github.com/lib/pq"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultPageSize is the number of customers listed when no limit is requested
+	defaultPageSize = 20
+	// maxPageSize is the maximum limit accepted when listing customers
+	maxPageSize = 100
 )
 
 type ListResponse struct {
 	Customers []*Customer `json:"customers"`
-}
-
-type Customer struct {
-	Name    string `json:"name"`
-	Address string `json:"address"`
+	// Number of customers matching the filter, ignoring pagination
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
 }
 
 type Handler struct {
-	connStr   string
-	agentSock string
-	log       *slog.Logger
+	store CustomerStore
+	log   *slog.Logger
 }
 
-func NewHandler(connStr string, agentSock string, log *slog.Logger) *Handler {
+func NewHandler(store CustomerStore, log *slog.Logger) *Handler {
 	return &Handler{
-		connStr:   connStr,
-		agentSock: agentSock,
-		log:       log,
+		store: store,
+		log:   log,
 	}
 }
 
+// CustomersList lists a page of customers, the page is selected with the
+// "limit" and "offset" query parameters and customers are filtered with the
+// "name" and "address" ones
 func (h *Handler) CustomersList(w http.ResponseWriter, r *http.Request) {
 	h.log.Info("List customers called...")
-	if r.Method != http.MethodGet {
-		h.log.Error("Invalid http method", "method", r.Method)
-		http.Error(w, "unexpected http method", http.StatusInternalServerError)
+	filter, reqErr := parseCustomerFilter(r.URL.Query())
+	if reqErr != nil {
+		h.log.Error("Invalid list parameters", "error", reqErr)
+		reqErr.Write(w)
 		return
 	}
 
-	// open database
-	db, err := sql.Open("postgres", h.connStr)
+	customers, total, err := h.store.List(r.Context(), filter)
 	if err != nil {
-		h.log.Error("Failed to connect database", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.internalError(w, "Failed to list customers", err)
 		return
 	}
+	if customers == nil {
+		customers = []*Customer{}
+	}
 
-	// close database
-	defer db.Close()
+	h.writeJSON(w, http.StatusOK, &ListResponse{
+		Customers: customers,
+		Total:     total,
+		Limit:     filter.Limit,
+		Offset:    filter.Offset,
+	})
+}
 
-	rows, err := db.Query(`SELECT "name", "address" FROM "customers"`)
-	if err != nil {
-		h.log.Error("Error executing query", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (h *Handler) CustomerInsert(w http.ResponseWriter, r *http.Request) {
+	h.log.Info("Insert customers called...")
+	req, ok := h.customerRequest(w, r, false)
+	if !ok {
 		return
 	}
-	defer rows.Close()
 
-	listResp := new(ListResponse)
-	for rows.Next() {
-		customer := &Customer{}
-		if err := rows.Scan(&customer.Name, &customer.Address); err != nil {
-			h.log.Error("Error retrieving customer", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		listResp.Customers = append(listResp.Customers, customer)
+	customer := Customer{Name: *req.Name, Address: *req.Address}
+	if err := h.store.Insert(r.Context(), &customer); err != nil {
+		h.internalError(w, "Failed to insert customer", err)
+		return
 	}
+	w.Header().Set("Location", fmt.Sprintf("/customers/%d", customer.ID))
+	h.writeJSON(w, http.StatusCreated, &customer)
+}
 
-	if err := rows.Err(); err != nil {
-		h.log.Error("Error iterating over rows", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (h *Handler) CustomerGet(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.customerID(w, r)
+	if !ok {
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(listResp); err != nil {
-		h.log.Error("Error processing payload", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	customer, err := h.store.Get(r.Context(), id)
+	if err != nil {
+		h.storeError(w, "Failed to get customer", id, err)
+		return
 	}
+	h.writeJSON(w, http.StatusOK, customer)
 }
 
-func (h *Handler) CustomerInsert(w http.ResponseWriter, r *http.Request) {
-	h.log.Info("Insert customers called...")
-	if r.Method != http.MethodPost {
-		h.log.Error("Invalid http method", "method", r.Method)
-		http.Error(w, "unexpected http method", http.StatusInternalServerError)
+// CustomerUpdate replaces every field of a customer
+func (h *Handler) CustomerUpdate(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.customerID(w, r)
+	if !ok {
+		return
+	}
+	req, ok := h.customerRequest(w, r, false)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
 
-	var customer Customer
-	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
-		h.log.Error("Failed to decode request", "error", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	customer := Customer{ID: id, Name: *req.Name, Address: *req.Address}
+	if err := h.store.Update(r.Context(), &customer); err != nil {
+		h.storeError(w, "Failed to update customer", id, err)
 		return
 	}
+	h.writeJSON(w, http.StatusOK, &customer)
+}
 
-	// open database
-	db, err := sql.Open("postgres", h.connStr)
+// CustomerPatch changes the fields present in the request
+func (h *Handler) CustomerPatch(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.customerID(w, r)
+	if !ok {
+		return
+	}
+	patch, ok := h.customerRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	customer, err := h.store.Get(r.Context(), id)
 	if err != nil {
-		h.log.Error("Failed to connect database", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.storeError(w, "Failed to get customer", id, err)
 		return
 	}
+	if patch.Name != nil {
+		customer.Name = *patch.Name
+	}
+	if patch.Address != nil {
+		customer.Address = *patch.Address
+	}
 
-	// close database
-	defer db.Close()
+	if err := h.store.Update(r.Context(), customer); err != nil {
+		h.storeError(w, "Failed to update customer", id, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, customer)
+}
 
-	insert := `INSERT INTO "customers"("name", "address") VALUES($1, $2)`
-	if _, err := db.Exec(insert, customer.Name, customer.Address); err != nil {
-		h.log.Error("Failed to insert customer", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (h *Handler) CustomerDelete(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.customerID(w, r)
+	if !ok {
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+
+	if err := h.store.Delete(r.Context(), id); err != nil {
+		h.storeError(w, "Failed to delete customer", id, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// customerID returns the ID in the request path, a bad request is written
+// when it is not valid
+func (h *Handler) customerID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	rawID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || id <= 0 {
+		h.log.Error("Invalid customer ID", "id", rawID)
+		service.WriteError(w, http.StatusBadRequest, service.CodeInvalidRequest, fmt.Sprintf("invalid customer ID %q", rawID))
+		return 0, false
+	}
+	return id, true
+}
+
+// customerRequest decodes and validates the request body, fields are only
+// required when partial is false. The error is written when it is not valid.
+func (h *Handler) customerRequest(w http.ResponseWriter, r *http.Request, partial bool) (*customerRequest, bool) {
+	defer r.Body.Close()
+
+	req := &customerRequest{}
+	reqErr := service.DecodeJSON(w, r, req, maxBodySize)
+	if reqErr == nil {
+		reqErr = req.validate(partial)
+	}
+	if reqErr != nil {
+		h.log.Error("Invalid request", "error", reqErr, "details", reqErr.Details)
+		reqErr.Write(w)
+		return nil, false
+	}
+	return req, true
+}
+
+// storeError writes not found for missing customers and an internal error
+// otherwise
+func (h *Handler) storeError(w http.ResponseWriter, msg string, id int64, err error) {
+	if errors.Is(err, errCustomerNotFound) {
+		h.log.Warn(msg, "id", id, "error", err)
+		service.WriteError(w, http.StatusNotFound, service.CodeNotFound, fmt.Sprintf("customer %d not found", id))
+		return
+	}
+	h.internalError(w, msg, err, "id", id)
+}
+
+// internalError logs err and hides it from the caller
+func (h *Handler) internalError(w http.ResponseWriter, msg string, err error, args ...any) {
+	h.log.Error(msg, append(args, "error", err)...)
+	service.WriteError(w, http.StatusInternalServerError, service.CodeInternal, "internal error, try again later")
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Error("Error processing payload", "error", err)
+	}
+}
+
+func parseCustomerFilter(query url.Values) (CustomerFilter, *service.RequestError) {
+	filter := CustomerFilter{
+		Name:    query.Get("name"),
+		Address: query.Get("address"),
+		Limit:   defaultPageSize,
+	}
+
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return CustomerFilter{}, service.InvalidFields(service.FieldError{
+				Field:   "limit",
+				Message: fmt.Sprintf("must be a number between 1 and %d", maxPageSize),
+			})
+		}
+		filter.Limit = limit
+	}
+	if rawOffset := query.Get("offset"); rawOffset != "" {
+		offset, err := strconv.Atoi(rawOffset)
+		if err != nil || offset < 0 {
+			return CustomerFilter{}, service.InvalidFields(service.FieldError{Field: "offset", Message: "must be a non-negative number"})
+		}
+		filter.Offset = offset
+	}
+	return filter, nil
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantAllow  string
+		wantBody   string
+		wantStored []*Customer
+	}{
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			target:     "/customers",
+			wantStatus: http.StatusOK,
+			wantBody: `{"customers":[{"id":1,"name":"Ana","address":"Parana"},{"id":2,"name":"Bruno","address":"Rosario"},` +
+				`{"id":3,"name":"Carla","address":"Santa Fe"}],"total":3,"limit":20,"offset":0}`,
+		},
+		{
+			name:       "list page",
+			method:     http.MethodGet,
+			target:     "/customers?limit=1&offset=1",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"customers":[{"id":2,"name":"Bruno","address":"Rosario"}],"total":3,"limit":1,"offset":1}`,
+		},
+		{
+			name:       "list filtered",
+			method:     http.MethodGet,
+			target:     "/customers?address=santa",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"customers":[{"id":3,"name":"Carla","address":"Santa Fe"}],"total":1,"limit":20,"offset":0}`,
+		},
+		{
+			name:       "list past last page",
+			method:     http.MethodGet,
+			target:     "/customers?offset=10",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"customers":[],"total":3,"limit":20,"offset":10}`,
+		},
+		{
+			name:       "list invalid limit",
+			method:     http.MethodGet,
+			target:     "/customers?limit=1000",
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"limit","message":"must be a number between 1 and 100"}]}}`,
+		},
+		{
+			name:       "list invalid offset",
+			method:     http.MethodGet,
+			target:     "/customers?offset=-1",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "create",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"Dario","address":"Cordoba"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id":4,"name":"Dario","address":"Cordoba"}`,
+		},
+		{
+			name:       "create trims fields",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":" Dario ","address":"Cordoba\n"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id":4,"name":"Dario","address":"Cordoba"}`,
+		},
+		{
+			name:       "create unknown field",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"id":1,"name":"Dario","address":"Cordoba"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"id","message":"is not a known field"}]}}`,
+		},
+		{
+			name:       "create missing fields",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"is required"},{"field":"address","message":"is required"}]}}`,
+		},
+		{
+			name:       "create empty name",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"  ","address":"Cordoba"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"must not be empty"}]}}`,
+		},
+		{
+			name:       "create name too long",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"` + strings.Repeat("ñ", maxNameLength+1) + `","address":"Cordoba"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"must be at most 40 characters"}]}}`,
+		},
+		{
+			name:       "create longest name",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"` + strings.Repeat("ñ", maxNameLength) + `","address":"Cordoba"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "create wrong type",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"Dario","address":12}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"address","message":"must be a string"}]}}`,
+		},
+		{
+			name:       "create not an object",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `["Dario"]`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"invalid_request","message":"request body must be a JSON object"}}`,
+		},
+		{
+			name:       "create invalid body",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"invalid_request","message":"request body is not valid JSON"}}`,
+		},
+		{
+			name:       "create empty body",
+			method:     http.MethodPost,
+			target:     "/customers",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"invalid_request","message":"request body is empty"}}`,
+		},
+		{
+			name:       "create trailing data",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"Dario","address":"Cordoba"}{}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"invalid_request","message":"request body must contain a single JSON object"}}`,
+		},
+		{
+			name:       "create body too large",
+			method:     http.MethodPost,
+			target:     "/customers",
+			body:       `{"name":"Dario","address":"` + strings.Repeat("a", maxBodySize) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   `{"error":{"code":"body_too_large","message":"request body must not be larger than 16384 bytes"}}`,
+		},
+		{
+			name:       "insert",
+			method:     http.MethodPost,
+			target:     "/customer/insert",
+			body:       `{"name":"Dario","address":"Cordoba"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id":4,"name":"Dario","address":"Cordoba"}`,
+		},
+		{
+			name:       "get",
+			method:     http.MethodGet,
+			target:     "/customers/2",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":2,"name":"Bruno","address":"Rosario"}`,
+		},
+		{
+			name:       "get missing",
+			method:     http.MethodGet,
+			target:     "/customers/42",
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":{"code":"not_found","message":"customer 42 not found"}}`,
+		},
+		{
+			name:       "get invalid ID",
+			method:     http.MethodGet,
+			target:     "/customers/abc",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "get zero ID",
+			method:     http.MethodGet,
+			target:     "/customers/0",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "update",
+			method:     http.MethodPut,
+			target:     "/customers/2",
+			body:       `{"name":"Bruno Diaz","address":"Rafaela"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":2,"name":"Bruno Diaz","address":"Rafaela"}`,
+		},
+		{
+			name:       "update requires every field",
+			method:     http.MethodPut,
+			target:     "/customers/2",
+			body:       `{"name":"Bruno Diaz"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"address","message":"is required"}]}}`,
+		},
+		{
+			name:       "update missing",
+			method:     http.MethodPut,
+			target:     "/customers/42",
+			body:       `{"name":"Bruno Diaz","address":"Rafaela"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "patch",
+			method:     http.MethodPatch,
+			target:     "/customers/2",
+			body:       `{"address":"Rafaela"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":2,"name":"Bruno","address":"Rafaela"}`,
+		},
+		{
+			name:       "patch empty field",
+			method:     http.MethodPatch,
+			target:     "/customers/2",
+			body:       `{"name":""}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"must not be empty"}]}}`,
+		},
+		{
+			name:       "patch missing",
+			method:     http.MethodPatch,
+			target:     "/customers/42",
+			body:       `{"address":"Rafaela"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "delete",
+			method:     http.MethodDelete,
+			target:     "/customers/2",
+			wantStatus: http.StatusNoContent,
+			wantStored: []*Customer{
+				{ID: 1, Name: "Ana", Address: "Parana"},
+				{ID: 3, Name: "Carla", Address: "Santa Fe"},
+			},
+		},
+		{
+			name:       "delete missing",
+			method:     http.MethodDelete,
+			target:     "/customers/42",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "collection method not allowed",
+			method:     http.MethodDelete,
+			target:     "/customers",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, POST",
+			wantBody:   `{"error":{"code":"method_not_allowed","message":"method DELETE is not allowed on /customers"}}`,
+		},
+		{
+			name:       "customer method not allowed",
+			method:     http.MethodPost,
+			target:     "/customers/1",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "DELETE, GET, PATCH, PUT",
+		},
+		{
+			name:       "insert method not allowed",
+			method:     http.MethodGet,
+			target:     "/customer/insert",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "POST",
+		},
+		{
+			name:       "unknown route",
+			method:     http.MethodGet,
+			target:     "/products",
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":{"code":"not_found","message":"route /products not found"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			for _, customer := range []*Customer{
+				{Name: "Ana", Address: "Parana"},
+				{Name: "Bruno", Address: "Rosario"},
+				{Name: "Carla", Address: "Santa Fe"},
+			} {
+				if err := store.Insert(context.Background(), customer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			router := newRouter(NewHandler(store, slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if allow := rec.Header().Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+			if tt.wantBody != "" {
+				if body := strings.TrimSpace(rec.Body.String()); body != tt.wantBody {
+					t.Errorf("body = %s, want %s", body, tt.wantBody)
+				}
+			}
+			if tt.wantStored != nil {
+				stored, err := json.Marshal(store.customers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := json.Marshal(tt.wantStored)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(stored) != string(want) {
+					t.Errorf("stored = %s, want %s", stored, want)
+				}
+			}
+		})
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"database/sql/driver"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"rotation"
+	"rotation/service"
 	"strconv"
 	"time"
 
@@ -14,7 +17,6 @@ import (
 	"github.com/spiffe/go-spiffe/v2/logger"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
-	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
@@ -26,15 +28,73 @@ var (
 type config struct {
 	Host      string `hcl:"host"`
 	Port      int    `hcl:"port"`
-	DBHost    string `hcl:"db_host"`
-	DBPort    string `hcl:"db_port"`
-	DBUser    string `hcl:"db_user"`
-	DBName    string `hcl:"db_name"`
 	AgentSock string `hcl:"agent_sock"`
+	// Where customers are kept, "postgres" or "memory". Defaults to
+	// "postgres", that requires the db_ fields.
+	Store  string `hcl:"store,optional"`
+	DBHost string `hcl:"db_host,optional"`
+	DBPort string `hcl:"db_port,optional"`
+	DBUser string `hcl:"db_user,optional"`
+	DBName string `hcl:"db_name,optional"`
+	// Trust domain of the service, "cluster.demo" when not set
+	TrustDomain string `hcl:"trust_domain,optional"`
+	// Trust domains federated with TrustDomain, their workloads are allowed
+	// to connect and present JWT-SVIDs
+	FederatedTrustDomains []string `hcl:"federated_trust_domains,optional"`
+	// Audiences accepted in JWT-SVIDs, the first one is used when this
+	// service fetches its own JWT-SVID. Defaults to "aud".
+	Audiences []string `hcl:"audiences,optional"`
+	// Plain HTTP port for status endpoints, disabled when 0
+	AdminPort int `hcl:"admin_port,optional"`
+	// Authority key IDs that are expected to be revoked
+	TaintedAuthorities []string `hcl:"tainted_authorities,optional"`
+
+	// By default SVID, key and bundle are written using the credentials block
+	// and loaded by lib/pq. When true they are only kept in memory and the
+	// database connection uses the SVID from the Workload API.
+	DisableCredentialFiles bool               `hcl:"disable_credential_files,optional"`
+	Credentials            *credentialsConfig `hcl:"credentials,block"`
+	// Routes access by caller SPIFFE ID
+	Policies []service.PolicyConfig `hcl:"policy,block"`
+	// When set, JWT-SVIDs must belong to the mTLS peer
+	PeerBinding *peerBindingConfig `hcl:"peer_binding,block"`
+}
+
+// validateStore sets the store default and verifies the database settings
+// are present when they are used
+func (c *config) validateStore() error {
+	switch c.Store {
+	case "":
+		c.Store = storePostgres
+		fallthrough
+	case storePostgres:
+		for _, field := range []struct{ name, value string }{
+			{"db_host", c.DBHost},
+			{"db_port", c.DBPort},
+			{"db_user", c.DBUser},
+			{"db_name", c.DBName},
+		} {
+			if field.value == "" {
+				return fmt.Errorf("%s is required by the %q store", field.name, storePostgres)
+			}
+		}
+	case storeMemory:
+		if c.DBHost != "" {
+			log.Warn("Customers are kept in memory, ignoring database configuration")
+		}
+	default:
+		return fmt.Errorf("unknown store %q, expected %q or %q", c.Store, storePostgres, storeMemory)
+	}
+	return nil
 }
 
 func start() error {
 	flag.Parse()
+	// The only subcommand is "migrate", the service runs without one
+	args := flag.Args()
+	if len(args) > 0 && args[0] != "migrate" {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
 
 	log.Info("Reading configuration file", "path", *configFilePath)
 	var c config
@@ -42,6 +102,55 @@ func start() error {
 		return fmt.Errorf("error parsing configuration file: %w", err)
 	}
 
+	identity, err := service.ParseIdentity(c.TrustDomain, c.FederatedTrustDomains, c.Audiences)
+	if err != nil {
+		return fmt.Errorf("invalid identity configuration: %w", err)
+	}
+	td, trusted := identity.TrustDomain, identity.Trusted
+	log.Info("Trusted trust domains", "trust_domain", td, "federated", c.FederatedTrustDomains)
+
+	if err := c.validateStore(); err != nil {
+		return fmt.Errorf("invalid store configuration: %w", err)
+	}
+	if len(args) > 0 && c.Store != storePostgres {
+		return fmt.Errorf("migrations require the %q store", storePostgres)
+	}
+
+	authz, err := service.NewAuthorizer(c.Policies, log)
+	if err != nil {
+		return fmt.Errorf("invalid policy configuration: %w", err)
+	}
+
+	var delegates []spiffeid.ID
+	if c.PeerBinding != nil {
+		if delegates, err = parseDelegates(c.PeerBinding); err != nil {
+			return fmt.Errorf("invalid peer binding configuration: %w", err)
+		}
+	}
+
+	// Credential files are only read by lib/pq
+	var writer *credentialWriter
+	switch {
+	case c.Store != storePostgres:
+		if c.Credentials != nil {
+			log.Warn("Credential files are only written for the database, ignoring credentials block")
+		}
+	case c.DisableCredentialFiles:
+		if c.Credentials != nil {
+			log.Warn("Credential files are disabled, ignoring credentials block")
+		}
+		log.Info("Credential files disabled, SVID is only kept in memory")
+	default:
+		if c.Credentials == nil {
+			c.Credentials = &credentialsConfig{}
+		}
+		c.Credentials.setDefaults()
+		if err := c.Credentials.validate(); err != nil {
+			return fmt.Errorf("invalid credentials configuration: %w", err)
+		}
+		writer = newCredentialWriter(c.Credentials)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -60,12 +169,64 @@ func start() error {
 	}
 	defer bundleSource.Close()
 
+	tracker := rotation.NewTracker(log)
+	taint := rotation.NewTaintDetector(c.TaintedAuthorities, log)
+	metrics := rotation.NewMetrics()
+	svids := &svidStore{writer: writer}
+	u := &service.X509Updater{
+		Source:   source,
+		Tracker:  tracker,
+		Taint:    taint,
+		Metrics:  metrics,
+		OnUpdate: svids.update,
+		Log:      log,
+	}
+
+	// Credential files must exist before the database is used
 	log.Info("Storing initial SVID")
-	if err := storeSVIDUpdate(source, log); err != nil {
+	if err := u.HandleUpdate(); err != nil {
 		return fmt.Errorf("failed to store SVID update: %w", err)
 	}
 
-	go monitorSVIDUpdates(ctx, source)
+	var store CustomerStore
+	switch c.Store {
+	case storePostgres:
+		connStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s", c.DBHost, c.DBPort, c.DBUser, c.DBName)
+		var connector driver.Connector
+		if writer != nil {
+			// lib/pq loads the SVID, key and bundle written by svids
+			connector = &fileConnector{connStr: connStr, writer: writer}
+		} else {
+			// TLS is negotiated by the database dialer, using the SVID in memory
+			connector, err = tlsConnector(connStr+" sslmode=disable",
+				tlsconfig.MTLSClientConfig(source, bundleSource, tlsconfig.AuthorizeMemberOf(td)))
+			if err != nil {
+				return fmt.Errorf("unable to create database: %w", err)
+			}
+		}
+		db := newDatabase(connector, log)
+		defer db.Close()
+		svids.db = db
+
+		m, err := newMigrator(db, log)
+		if err != nil {
+			return fmt.Errorf("invalid migrations: %w", err)
+		}
+		if len(args) > 0 {
+			return runMigration(ctx, m, args[1:], os.Stdout)
+		}
+		// Replicas wait for each other, so the schema is migrated once
+		log.Info("Applying database migrations")
+		if err := m.up(ctx); err != nil {
+			return fmt.Errorf("failed to migrate database: %w", err)
+		}
+		store = newPostgresStore(db)
+	case storeMemory:
+		log.Warn("Customers are kept in memory and lost on restart")
+		store = newMemoryStore()
+	}
+
+	go u.Monitor(ctx)
 
 	jwtSource, err := workloadapi.NewJWTSource(ctx, clientOptions)
 	if err != nil {
@@ -73,24 +234,40 @@ func start() error {
 	}
 	defer jwtSource.Close()
 
-	go monitorJWTUpdates(ctx, jwtSource)
+	jwtUpdater := &service.JWTUpdater{
+		Source:      jwtSource,
+		TrustDomain: td,
+		Audience:    identity.Audiences[0],
+		Tracker:     tracker,
+		Taint:       taint,
+		Metrics:     metrics,
+		Log:         log,
+	}
+	go jwtUpdater.Monitor(ctx)
+
+	go service.MonitorBundleUpdates(ctx, bundleSource, trusted, tracker, metrics, taint)
 
 	auth := &authenticator{
-		jwtSource: jwtSource,
-		audiences: []string{"aud"},
-		log:       log,
+		jwtSource:   jwtSource,
+		bundles:     &service.TrustedBundles{Source: bundleSource, TrustDomains: trusted},
+		trustDomain: td,
+		audiences:   identity.Audiences,
+		validations: service.NewValidationsCounter(),
+		bindPeer:    c.PeerBinding != nil,
+		delegates:   delegates,
+		log:         log,
 	}
+	metrics.MustRegister(auth.validations)
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslcert=%s sslkey=%s sslrootcert=%s",
-		c.DBHost, c.DBPort, c.DBUser, c.DBName, "svid.pem", "svid.key", "bundle.pem")
-	h := NewHandler(connStr, c.AgentSock, log)
-	http.Handle("/customers", auth.authenticateClient(http.HandlerFunc(h.CustomersList)))
-	http.Handle("/customer/insert", auth.authenticateClient(http.HandlerFunc(h.CustomerInsert)))
+	if c.AdminPort != 0 {
+		go service.ServeAdmin(c.AdminPort, service.NewAdminHandler(taint, metrics, tracker), log)
+	}
 
-	td := spiffeid.RequireTrustDomainFromString("cluster.demo")
-	tlsConfig := tlsconfig.MTLSServerConfig(source, bundleSource, tlsconfig.AuthorizeMemberOf(td))
+	// Peers from federated trust domains are verified with their own bundle
+	tlsConfig := tlsconfig.MTLSServerConfig(source, bundleSource, tlsconfig.AdaptMatcher(rotation.MatchMemberOfAny(trusted)))
 	server := &http.Server{
 		Addr:              ":" + strconv.Itoa(c.Port),
+		Handler:           newAPIHandler(NewHandler(store, log), auth, authz),
 		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: time.Second * 10,
 	}
@@ -99,45 +276,6 @@ func start() error {
 	return server.ListenAndServeTLS("", "")
 }
 
-func monitorSVIDUpdates(ctx context.Context, source *workloadapi.X509Source) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-source.Updated():
-			if err := storeSVIDUpdate(source, log); err != nil {
-				log.Error("Failed to store SVID update", "error", err)
-			}
-		}
-	}
-}
-
-func monitorJWTUpdates(ctx context.Context, jwtSource *workloadapi.JWTSource) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-jwtSource.Updated():
-			jwtBundle, err := jwtSource.GetJWTBundleForTrustDomain(spiffeid.RequireTrustDomainFromString("cluster.demo"))
-			if err != nil {
-				log.Error("Failed to get JWT bundle", "error", err)
-				continue
-			}
-
-			for skid := range jwtBundle.JWTAuthorities() {
-				log.Info("JWT authority found", "key_id", skid)
-			}
-
-			jwtSVID, err := jwtSource.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "aud"})
-			if err != nil {
-				log.Error("Failed to fetch JWT SVID", "error", err)
-				continue
-			}
-			log.Info("JWT SVID fetched", "marshal", jwtSVID.Marshal())
-		}
-	}
-}
-
 func main() {
 	if err := start(); err != nil {
 		log.Error("Service failed to start", "error", err)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps customers in memory, they are lost when the service
+// stops. It allows running the API without a database.
+type memoryStore struct {
+	mu        sync.RWMutex
+	customers []*Customer
+	nextID    int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{nextID: 1}
+}
+
+func (s *memoryStore) List(_ context.Context, filter CustomerFilter) ([]*Customer, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, address := strings.ToLower(filter.Name), strings.ToLower(filter.Address)
+	var matching []*Customer
+	for _, customer := range s.customers {
+		if strings.Contains(strings.ToLower(customer.Name), name) &&
+			strings.Contains(strings.ToLower(customer.Address), address) {
+			matching = append(matching, customer)
+		}
+	}
+
+	start := min(filter.Offset, len(matching))
+	end := min(start+filter.Limit, len(matching))
+	page := make([]*Customer, 0, end-start)
+	for _, customer := range matching[start:end] {
+		page = append(page, copyCustomer(customer))
+	}
+	return page, len(matching), nil
+}
+
+func (s *memoryStore) Get(_ context.Context, id int64) (*Customer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.index(id)
+	if i < 0 {
+		return nil, errCustomerNotFound
+	}
+	return copyCustomer(s.customers[i]), nil
+}
+
+func (s *memoryStore) Insert(_ context.Context, customer *Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	customer.ID = s.nextID
+	s.nextID++
+	s.customers = append(s.customers, copyCustomer(customer))
+	return nil
+}
+
+func (s *memoryStore) Update(_ context.Context, customer *Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.index(customer.ID)
+	if i < 0 {
+		return errCustomerNotFound
+	}
+	s.customers[i] = copyCustomer(customer)
+	return nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.index(id)
+	if i < 0 {
+		return errCustomerNotFound
+	}
+	s.customers = slices.Delete(s.customers, i, i+1)
+	return nil
+}
+
+// index returns the position of the customer with id, customers are kept
+// ordered by ID
+func (s *memoryStore) index(id int64) int {
+	i, found := slices.BinarySearchFunc(s.customers, id, func(c *Customer, id int64) int {
+		return cmp.Compare(c.ID, id)
+	})
+	if !found {
+		return -1
+	}
+	return i
+}
+
+// copyCustomer prevents callers from changing stored customers
+func copyCustomer(customer *Customer) *Customer {
+	c := *customer
+	return &c
+}
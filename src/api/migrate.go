@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// migrationLockKey identifies the advisory lock held while migrating, so
+// replicas starting together apply each migration once
+const migrationLockKey = 7_390_211_042
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationFileName matches "<version>_<name>.<up|down>.sql"
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migration is a versioned schema change with the statements to revert it
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+// migrationStatus is a known migration and when it was applied, AppliedAt
+// is nil for pending migrations
+type migrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the migrations in dir of fsys ordered by version,
+// every version must have an up and a down file
+func loadMigrations(fsys fs.FS, dir string) ([]*migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		matches := migrationFileName.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: matches[2]}
+			byVersion[version] = m
+		}
+		if m.name != matches[2] {
+			return nil, fmt.Errorf("migration %d has names %q and %q", version, m.name, matches[2])
+		}
+		if matches[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	var migrations []*migration
+	for _, version := range slices.Sorted(maps.Keys(byVersion)) {
+		m := byVersion[version]
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s requires an up and a down file", m.version, m.name)
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// migrator applies migrations to the database, holding an advisory lock
+// and recording applied versions in the "schema_migrations" table
+type migrator struct {
+	db         *database
+	migrations []*migration
+	log        *slog.Logger
+}
+
+func newMigrator(db *database, log *slog.Logger) (*migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: migrations, log: log}, nil
+}
+
+// up applies every pending migration in order
+func (m *migrator) up(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.version]; ok {
+				continue
+			}
+			m.log.Info("Applying migration", "version", migration.version, "name", migration.name)
+			if err := m.apply(ctx, conn, migration.up,
+				`INSERT INTO "schema_migrations"("version", "name") VALUES($1, $2)`, migration.version, migration.name); err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", migration.version, migration.name, err)
+			}
+			count++
+		}
+		m.log.Info("Schema is up to date", "applied", count, "version", lastVersion(m.migrations))
+		return nil
+	})
+}
+
+// down reverts the last applied migration
+func (m *migrator) down(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range slices.Backward(m.migrations) {
+			if _, ok := applied[migration.version]; !ok {
+				continue
+			}
+			m.log.Info("Reverting migration", "version", migration.version, "name", migration.name)
+			if err := m.apply(ctx, conn, migration.down,
+				`DELETE FROM "schema_migrations" WHERE "version" = $1`, migration.version); err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", migration.version, migration.name, err)
+			}
+			return nil
+		}
+		m.log.Info("No migrations to revert")
+		return nil
+	})
+}
+
+// status returns every known migration with the time it was applied
+func (m *migrator) status(ctx context.Context) ([]migrationStatus, error) {
+	var statuses []migrationStatus
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := migrationStatus{Version: migration.version, Name: migration.name}
+			if appliedAt, ok := applied[migration.version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		for version := range applied {
+			if !slices.ContainsFunc(m.migrations, func(migration *migration) bool { return migration.version == version }) {
+				m.log.Warn("Applied migration is unknown, the database is newer than the service", "version", version)
+			}
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// locked runs fn on a single connection holding the migration lock, it
+// waits while another replica is migrating. The connection is taken outside
+// of database.do, so waiting for the lock does not block SVID rotations.
+func (m *migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	m.log.Debug("Acquiring migration lock")
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		// The context may be done, the lock must be released anyway
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			m.log.Error("Failed to release migration lock, closing the connection", "error", err)
+			// The lock is held by the session, so the connection must not
+			// return to the pool. It is discarded instead, which ends the
+			// session and releases the lock.
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS "schema_migrations" (
+		"version" bigint PRIMARY KEY,
+		"name" text NOT NULL,
+		"applied_at" timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+// apply runs statements and record in a single transaction
+func (m *migrator) apply(ctx context.Context, conn *sql.Conn, statements, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	return tx.Commit()
+}
+
+// appliedMigrations returns when each applied version was applied
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT "version", "applied_at" FROM "schema_migrations"`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to read applied migration: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over applied migrations: %w", err)
+	}
+	return applied, nil
+}
+
+func lastVersion(migrations []*migration) int64 {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// runMigration runs the migrate subcommand, args are the subcommand arguments
+func runMigration(ctx context.Context, m *migrator, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return m.up(ctx)
+	case "down":
+		return m.down(ctx)
+	case "status":
+		statuses, err := m.status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			t.Errorf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(content string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(content)} }
+
+	tests := []struct {
+		name         string
+		files        fstest.MapFS
+		wantVersions []int64
+		wantErr      string
+	}{
+		{
+			name: "ordered by version",
+			files: fstest.MapFS{
+				"m/0010_second.up.sql":   file("up 10"),
+				"m/0010_second.down.sql": file("down 10"),
+				"m/0002_first.up.sql":    file("up 2"),
+				"m/0002_first.down.sql":  file("down 2"),
+			},
+			wantVersions: []int64{2, 10},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql": file("up 1"),
+			},
+			wantErr: "requires an up and a down file",
+		},
+		{
+			name: "different names",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql":   file("up 1"),
+				"m/0001_other.down.sql": file("down 1"),
+			},
+			wantErr: `migration 1 has names "first" and "other"`,
+		},
+		{
+			name: "invalid name",
+			files: fstest.MapFS{
+				"m/first.sql": file("up"),
+			},
+			wantErr: `invalid migration file name "first.sql"`,
+		},
+		{
+			name: "zero version",
+			files: fstest.MapFS{
+				"m/0000_first.up.sql":   file("up 0"),
+				"m/0000_first.down.sql": file("down 0"),
+			},
+			wantErr: "invalid migration version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "m")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var versions []int64
+			for _, m := range migrations {
+				versions = append(versions, m.version)
+				if !strings.HasPrefix(m.up, "up") || !strings.HasPrefix(m.down, "down") {
+					t.Errorf("migration %d has up %q and down %q", m.version, m.up, m.down)
+				}
+			}
+			if len(versions) != len(tt.wantVersions) {
+				t.Fatalf("versions = %v, want %v", versions, tt.wantVersions)
+			}
+			for i := range versions {
+				if versions[i] != tt.wantVersions[i] {
+					t.Fatalf("versions = %v, want %v", versions, tt.wantVersions)
+				}
+			}
+		})
+	}
+}
+
+// fakeMigrationDB is a database/sql driver that understands the statements
+// sent by the migrator. Migration statements are recorded when their
+// transaction commits, the advisory lock is held by a single connection and
+// released when it is closed, as Postgres does when the session ends.
+type fakeMigrationDB struct {
+	lock chan struct{}
+
+	mu       sync.Mutex
+	applied  map[int64]time.Time
+	executed []string
+	// fail is a migration statement that fails when executed
+	fail string
+	// failUnlock makes releasing the advisory lock fail
+	failUnlock bool
+	// closed counts closed connections
+	closed int
+}
+
+func newFakeMigrationDB() *fakeMigrationDB {
+	return &fakeMigrationDB{
+		lock:    make(chan struct{}, 1),
+		applied: make(map[int64]time.Time),
+	}
+}
+
+func (d *fakeMigrationDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeMigrationConn{db: d}, nil
+}
+
+func (d *fakeMigrationDB) Driver() driver.Driver { return nil }
+
+func (d *fakeMigrationDB) locked() bool {
+	return len(d.lock) > 0
+}
+
+func (d *fakeMigrationDB) versions() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Sorted(maps.Keys(d.applied))
+}
+
+func (d *fakeMigrationDB) statements() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.executed...)
+}
+
+type fakeMigrationConn struct {
+	db *fakeMigrationDB
+	// holdsLock is set while the connection holds the advisory lock
+	holdsLock bool
+	// tx holds the changes of the open transaction until it commits
+	tx *fakeMigrationTx
+}
+
+type fakeMigrationTx struct {
+	conn     *fakeMigrationConn
+	executed []string
+	applied  map[int64]bool
+}
+
+func (c *fakeMigrationConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *fakeMigrationConn) Close() error {
+	if c.holdsLock {
+		c.holdsLock = false
+		<-c.db.lock
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.closed++
+	return nil
+}
+
+func (c *fakeMigrationConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeMigrationConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.tx = &fakeMigrationTx{conn: c, applied: make(map[int64]bool)}
+	return c.tx, nil
+}
+
+func (c *fakeMigrationConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT pg_advisory_lock("):
+		if args[0].Value != int64(migrationLockKey) {
+			return nil, fmt.Errorf("unexpected lock key %v", args[0].Value)
+		}
+		select {
+		case c.db.lock <- struct{}{}:
+			c.holdsLock = true
+			return driver.ResultNoRows, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	case strings.HasPrefix(query, "SELECT pg_advisory_unlock("):
+		c.db.mu.Lock()
+		failUnlock := c.db.failUnlock
+		c.db.mu.Unlock()
+		if failUnlock {
+			return nil, errors.New("connection reset")
+		}
+		c.holdsLock = false
+		<-c.db.lock
+		return driver.ResultNoRows, nil
+	case strings.HasPrefix(query, `CREATE TABLE IF NOT EXISTS "schema_migrations"`):
+		return driver.ResultNoRows, nil
+	}
+
+	if c.tx == nil {
+		return nil, fmt.Errorf("%q executed outside a transaction", query)
+	}
+	switch {
+	case strings.HasPrefix(query, `INSERT INTO "schema_migrations"`):
+		c.tx.applied[args[0].Value.(int64)] = true
+	case strings.HasPrefix(query, `DELETE FROM "schema_migrations"`):
+		c.tx.applied[args[0].Value.(int64)] = false
+	default:
+		c.db.mu.Lock()
+		fail := c.db.fail
+		c.db.mu.Unlock()
+		if query == fail {
+			return nil, fmt.Errorf("%q failed", query)
+		}
+		c.tx.executed = append(c.tx.executed, query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeMigrationConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, `SELECT "version", "applied_at" FROM "schema_migrations"`) {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	rows := &fakeMigrationRows{}
+	for version, appliedAt := range c.db.applied {
+		rows.values = append(rows.values, []driver.Value{version, appliedAt})
+	}
+	return rows, nil
+}
+
+func (tx *fakeMigrationTx) Commit() error {
+	db := tx.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.executed = append(db.executed, tx.executed...)
+	for version, applied := range tx.applied {
+		if applied {
+			db.applied[version] = time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+		} else {
+			delete(db.applied, version)
+		}
+	}
+	tx.conn.tx = nil
+	return nil
+}
+
+func (tx *fakeMigrationTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+type fakeMigrationRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeMigrationRows) Columns() []string { return []string{"version", "applied_at"} }
+
+func (r *fakeMigrationRows) Close() error { return nil }
+
+func (r *fakeMigrationRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func (d *fakeMigrationDB) closedConns() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+func newTestMigrator(t *testing.T, fakeDB *fakeMigrationDB) *migrator {
+	db := newDatabase(fakeDB, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { db.Close() })
+
+	return &migrator{
+		db: db,
+		migrations: []*migration{
+			{version: 1, name: "first", up: "up 1", down: "down 1"},
+			{version: 2, name: "second", up: "up 2", down: "down 2"},
+		},
+		log: db.log,
+	}
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	fakeDB := newFakeMigrationDB()
+	m := newTestMigrator(t, fakeDB)
+
+	steps := []struct {
+		name           string
+		run            func(context.Context) error
+		wantVersions   []int64
+		wantStatements []string
+	}{
+		{name: "up", run: m.up, wantVersions: []int64{1, 2}, wantStatements: []string{"up 1", "up 2"}},
+		{name: "up to date", run: m.up, wantVersions: []int64{1, 2}, wantStatements: []string{"up 1", "up 2"}},
+		{name: "down", run: m.down, wantVersions: []int64{1}, wantStatements: []string{"up 1", "up 2", "down 2"}},
+		{name: "down again", run: m.down, wantVersions: nil, wantStatements: []string{"up 1", "up 2", "down 2", "down 1"}},
+		{name: "nothing to revert", run: m.down, wantVersions: nil, wantStatements: []string{"up 1", "up 2", "down 2", "down 1"}},
+	}
+	for _, step := range steps {
+		if err := step.run(ctx); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if versions := fakeDB.versions(); !slices.Equal(versions, step.wantVersions) {
+			t.Fatalf("%s: applied versions = %v, want %v", step.name, versions, step.wantVersions)
+		}
+		if statements := fakeDB.statements(); !slices.Equal(statements, step.wantStatements) {
+			t.Fatalf("%s: statements = %q, want %q", step.name, statements, step.wantStatements)
+		}
+		if fakeDB.locked() {
+			t.Fatalf("%s: migration lock was not released", step.name)
+		}
+	}
+}
+
+func TestMigratorUpFailure(t *testing.T) {
+	fakeDB := newFakeMigrationDB()
+	fakeDB.fail = "up 2"
+	m := newTestMigrator(t, fakeDB)
+
+	err := m.up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "migration 2_second failed") {
+		t.Fatalf("error = %v, want migration 2_second failed", err)
+	}
+	// The failed migration is not recorded, previous ones stay applied
+	if versions := fakeDB.versions(); !slices.Equal(versions, []int64{1}) {
+		t.Fatalf("applied versions = %v, want [1]", versions)
+	}
+	if fakeDB.locked() {
+		t.Fatal("migration lock was not released after a failure")
+	}
+}
+
+// TestMigratorWaitsForLock verifies nothing is migrated while another
+// replica holds the migration lock
+func TestMigratorWaitsForLock(t *testing.T) {
+	fakeDB := newFakeMigrationDB()
+	m := newTestMigrator(t, fakeDB)
+
+	// Another replica is migrating
+	fakeDB.lock <- struct{}{}
+
+	done := make(chan error, 1)
+	go func() { done <- m.up(context.Background()) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("migrated while the lock was held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if statements := fakeDB.statements(); len(statements) != 0 {
+		t.Fatalf("statements executed while the lock was held: %q", statements)
+	}
+
+	<-fakeDB.lock
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("migration did not run after the lock was released")
+	}
+	if versions := fakeDB.versions(); !slices.Equal(versions, []int64{1, 2}) {
+		t.Fatalf("applied versions = %v, want [1 2]", versions)
+	}
+
+	// Giving up waiting for the lock is an error
+	fakeDB.lock <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.up(ctx); err == nil || !strings.Contains(err.Error(), "failed to acquire migration lock") {
+		t.Fatalf("error = %v, want failed to acquire migration lock", err)
+	}
+}
+
+// TestMigratorUnlockFailure verifies a connection that may still hold the
+// migration lock is closed instead of returned to the pool
+func TestMigratorUnlockFailure(t *testing.T) {
+	fakeDB := newFakeMigrationDB()
+	fakeDB.failUnlock = true
+	m := newTestMigrator(t, fakeDB)
+
+	if err := m.up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if closed := fakeDB.closedConns(); closed != 1 {
+		t.Fatalf("%d connections closed, want 1", closed)
+	}
+	if fakeDB.locked() {
+		t.Fatal("migration lock is still held")
+	}
+
+	// The lock is acquired again on a new connection
+	fakeDB.mu.Lock()
+	fakeDB.failUnlock = false
+	fakeDB.mu.Unlock()
+	if err := m.down(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if versions := fakeDB.versions(); !slices.Equal(versions, []int64{1}) {
+		t.Fatalf("applied versions = %v, want [1]", versions)
+	}
+}
+
+// TestMigratorWaitDoesNotBlockRotation verifies the database can rotate
+// while the migrator waits for the lock
+func TestMigratorWaitDoesNotBlockRotation(t *testing.T) {
+	fakeDB := newFakeMigrationDB()
+	m := newTestMigrator(t, fakeDB)
+
+	// Another replica is migrating
+	fakeDB.lock <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- m.up(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+
+	rotated := make(chan struct{})
+	go func() {
+		m.db.rotate()
+		close(rotated)
+	}()
+	select {
+	case <-rotated:
+	case <-time.After(5 * time.Second):
+		cancel()
+		t.Fatal("rotation blocked while waiting for the migration lock")
+	}
+
+	cancel()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "failed to acquire migration lock") {
+		t.Fatalf("error = %v, want failed to acquire migration lock", err)
+	}
+}
+
+func TestRunMigration(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantVersions []int64
+		wantOutput   string
+		wantErr      string
+	}{
+		{
+			name:    "no command",
+			wantErr: "usage: migrate up|down|status",
+		},
+		{
+			name:    "too many arguments",
+			args:    []string{"up", "down"},
+			wantErr: "usage: migrate up|down|status",
+		},
+		{
+			name:    "unknown command",
+			args:    []string{"sideways"},
+			wantErr: `unknown migrate command "sideways", expected up, down or status`,
+		},
+		{
+			name:         "up",
+			args:         []string{"up"},
+			wantVersions: []int64{1, 2},
+		},
+		{
+			name:         "down",
+			args:         []string{"down"},
+			wantVersions: []int64{},
+		},
+		{
+			name:         "status",
+			args:         []string{"status"},
+			wantVersions: []int64{1},
+			wantOutput: "VERSION  NAME    APPLIED AT\n" +
+				"1        first   2024-10-01T12:00:00Z\n" +
+				"2        second  pending\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDB := newFakeMigrationDB()
+			m := newTestMigrator(t, fakeDB)
+			// One migration is applied before the command runs
+			if err := m.apply(context.Background(), mustConn(t, m), "up 1",
+				`INSERT INTO "schema_migrations"("version", "name") VALUES($1, $2)`, int64(1), "first"); err != nil {
+				t.Fatal(err)
+			}
+
+			out := &strings.Builder{}
+			err := runMigration(context.Background(), m, tt.args, out)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.wantOutput {
+				t.Errorf("output = %q, want %q", out.String(), tt.wantOutput)
+			}
+			if versions := fakeDB.versions(); !slices.Equal(versions, tt.wantVersions) {
+				t.Errorf("applied versions = %v, want %v", versions, tt.wantVersions)
+			}
+		})
+	}
+}
+
+func mustConn(t *testing.T, m *migrator) *sql.Conn {
+	t.Helper()
+	conn, err := m.db.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
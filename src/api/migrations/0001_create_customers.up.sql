@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS customers (
+    id bigserial PRIMARY KEY,
+    name varchar(40) NOT NULL,
+    address text NOT NULL
+);
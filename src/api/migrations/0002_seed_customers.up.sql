@@ -0,0 +1,3 @@
+INSERT INTO customers (name, address)
+SELECT 'Roberto Sanchez', 'El mirador 1234, Parana, Entre Rios'
+WHERE NOT EXISTS (SELECT 1 FROM customers);
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"rotation/service"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// newAPIHandler authenticates every request, policies are applied to the
+// matched route so they can use its path template
+func newAPIHandler(h *Handler, auth *authenticator, authz *service.Authorizer) http.Handler {
+	return auth.authenticateClient(newRouter(h, authz.Middleware(routeTemplate)))
+}
+
+// newRouter registers the customer routes, middlewares run only for
+// requests matching a route and method
+func newRouter(h *Handler, middlewares ...mux.MiddlewareFunc) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(middlewares...)
+	r.MethodNotAllowedHandler = methodNotAllowed(r)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		service.WriteError(w, http.StatusNotFound, service.CodeNotFound, fmt.Sprintf("route %s not found", req.URL.Path))
+	})
+
+	r.HandleFunc("/customers", h.CustomersList).Methods(http.MethodGet)
+	r.HandleFunc("/customers", h.CustomerInsert).Methods(http.MethodPost)
+	r.HandleFunc("/customers/{id:[0-9]+}", h.CustomerGet).Methods(http.MethodGet)
+	r.HandleFunc("/customers/{id:[0-9]+}", h.CustomerUpdate).Methods(http.MethodPut)
+	r.HandleFunc("/customers/{id:[0-9]+}", h.CustomerPatch).Methods(http.MethodPatch)
+	r.HandleFunc("/customers/{id:[0-9]+}", h.CustomerDelete).Methods(http.MethodDelete)
+	// Kept for clients created before POST /customers
+	r.HandleFunc("/customer/insert", h.CustomerInsert).Methods(http.MethodPost)
+
+	return r
+}
+
+// methodNotAllowed responds with the methods allowed on the requested path
+// in the Allow header
+func methodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var allowed []string
+		_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			var match mux.RouteMatch
+			if !route.Match(req, &match) && !errors.Is(match.MatchErr, mux.ErrMethodMismatch) {
+				return nil
+			}
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+			for _, method := range methods {
+				if !slices.Contains(allowed, method) {
+					allowed = append(allowed, method)
+				}
+			}
+			return nil
+		})
+		slices.Sort(allowed)
+
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		service.WriteError(w, http.StatusMethodNotAllowed, service.CodeMethodNotAllowed,
+			fmt.Sprintf("method %s is not allowed on %s", req.Method, req.URL.Path))
+	})
+}
+
+// routeTemplate returns the path template of the route matched by the
+// router, or the request path when no route was matched
+func routeTemplate(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return req.URL.Path
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rotation/service"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// testIssuer signs JWT-SVIDs for a trust domain
+type testIssuer struct {
+	td    spiffeid.TrustDomain
+	keyID string
+	key   crypto.Signer
+}
+
+func newTestIssuer(t *testing.T, td string) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{td: spiffeid.RequireTrustDomainFromString(td), keyID: td + "-key", key: key}
+}
+
+func (i *testIssuer) bundle() *jwtbundle.Bundle {
+	bundle := jwtbundle.New(i.td)
+	bundle.AddJWTAuthority(i.keyID, i.key.Public())
+	return bundle
+}
+
+func (i *testIssuer) token(t *testing.T, path, audience string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: i.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", i.keyID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  spiffeid.RequireFromPath(i.td, path).String(),
+		Audience: jwt.Audience{audience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestAPIHandler runs the API with an in-memory store, authenticating and
+// authorizing callers with JWT-SVIDs as the service does
+func TestAPIHandler(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	issuer := newTestIssuer(t, "cluster.demo")
+	untrusted := newTestIssuer(t, "other.demo")
+
+	bundles := jwtbundle.NewSet(issuer.bundle(), untrusted.bundle())
+	auth := &authenticator{
+		bundles:     &service.TrustedBundles{Source: bundles, TrustDomains: []spiffeid.TrustDomain{issuer.td}},
+		trustDomain: issuer.td,
+		audiences:   []string{"aud"},
+		validations: service.NewValidationsCounter(),
+		log:         log,
+	}
+	authz, err := service.NewAuthorizer([]service.PolicyConfig{
+		{
+			Route:      "/customers",
+			Methods:    []string{"GET"},
+			AllowedIDs: []string{"spiffe://cluster.demo/ns/client-ns/sa/default"},
+		},
+		{
+			Route:               "/customers/{id:[0-9]+}",
+			Methods:             []string{"GET", "DELETE"},
+			AllowedPathPatterns: []string{"/ns/client-ns/sa/[^/]+"},
+			AllowedTrustDomain:  "cluster.demo",
+		},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := issuer.token(t, "/ns/client-ns/sa/default", "aud")
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		auth       string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "no token",
+			method:     http.MethodGet,
+			target:     "/customers",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "malformed header",
+			method:     http.MethodGet,
+			target:     "/customers",
+			auth:       "Basic " + client,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "invalid token",
+			method:     http.MethodGet,
+			target:     "/customers",
+			auth:       "Bearer " + client[:len(client)-4],
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "wrong audience",
+			method:     http.MethodGet,
+			target:     "/customers",
+			auth:       "Bearer " + issuer.token(t, "/ns/client-ns/sa/default", "other"),
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "untrusted trust domain",
+			method:     http.MethodGet,
+			target:     "/customers",
+			auth:       "Bearer " + untrusted.token(t, "/ns/client-ns/sa/default", "aud"),
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			target:     "/customers",
+			auth:       "Bearer " + client,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "get by route template",
+			method:     http.MethodGet,
+			target:     "/customers/1",
+			auth:       "Bearer " + issuer.token(t, "/ns/client-ns/sa/reporter", "aud"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "caller not allowed",
+			method:     http.MethodGet,
+			target:     "/customers",
+			auth:       "Bearer " + issuer.token(t, "/ns/client-ns/sa/reporter", "aud"),
+			wantStatus: http.StatusForbidden,
+			wantCode:   "forbidden",
+		},
+		{
+			name:       "method without policy",
+			method:     http.MethodPut,
+			target:     "/customers/1",
+			auth:       "Bearer " + client,
+			wantStatus: http.StatusForbidden,
+			wantCode:   "forbidden",
+		},
+		{
+			name:       "method not allowed",
+			method:     http.MethodPost,
+			target:     "/customers/1",
+			auth:       "Bearer " + client,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   "method_not_allowed",
+		},
+		{
+			name:       "delete",
+			method:     http.MethodDelete,
+			target:     "/customers/1",
+			auth:       "Bearer " + client,
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			if err := store.Insert(context.Background(), &Customer{Name: "Ana", Address: "Parana"}); err != nil {
+				t.Fatal(err)
+			}
+			handler := newAPIHandler(NewHandler(store, log), auth, authz)
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(""))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var resp service.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if resp.Error.Code != tt.wantCode || resp.Error.Message == "" {
+				t.Errorf("error = %+v, want code %q and a message", resp.Error, tt.wantCode)
+			}
+		})
+	}
+}
+
+// TestPeerBinding verifies a valid JWT-SVID is only accepted from the mTLS
+// peer it was issued to, or from a delegate
+func TestPeerBinding(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	issuer := newTestIssuer(t, "cluster.demo")
+	auth := &authenticator{
+		bundles:     issuer.bundle(),
+		trustDomain: issuer.td,
+		audiences:   []string{"aud"},
+		validations: service.NewValidationsCounter(),
+		bindPeer:    true,
+		delegates:   []spiffeid.ID{spiffeid.RequireFromPath(issuer.td, "/ns/gateway-ns/sa/default")},
+		log:         log,
+	}
+	handler := auth.authenticateClient(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	token := issuer.token(t, "/ns/client-ns/sa/default", "aud")
+	tests := []struct {
+		name       string
+		peer       string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "token issued to the peer",
+			peer:       "/ns/client-ns/sa/default",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "token presented by a delegate",
+			peer:       "/ns/gateway-ns/sa/default",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "token issued to another workload",
+			peer:       "/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusForbidden,
+			wantCode:   "forbidden",
+		},
+		{
+			name:       "no peer certificate",
+			wantStatus: http.StatusForbidden,
+			wantCode:   "forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/customers", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.TLS = &tls.ConnectionState{}
+			if tt.peer != "" {
+				req.TLS.PeerCertificates = []*x509.Certificate{
+					{URIs: []*url.URL{spiffeid.RequireFromPath(issuer.td, tt.peer).URL()}},
+				}
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var resp service.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if resp.Error.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", resp.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Supported stores
+const (
+	storePostgres = "postgres"
+	storeMemory   = "memory"
+)
+
+// errCustomerNotFound is returned by stores when no customer has the
+// requested ID
+var errCustomerNotFound = errors.New("customer not found")
+
+type Customer struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// CustomerFilter selects a page of customers. Name and Address match
+// customers containing them, ignoring case, and are not applied when empty.
+type CustomerFilter struct {
+	Name    string
+	Address string
+	Limit   int
+	Offset  int
+}
+
+// CustomerStore persists customers
+type CustomerStore interface {
+	// List returns the customers matching filter ordered by ID, together
+	// with the number of matching customers ignoring Limit and Offset
+	List(ctx context.Context, filter CustomerFilter) ([]*Customer, int, error)
+	Get(ctx context.Context, id int64) (*Customer, error)
+	// Insert adds customer and sets its ID
+	Insert(ctx context.Context, customer *Customer) error
+	Update(ctx context.Context, customer *Customer) error
+	Delete(ctx context.Context, id int64) error
+}
+
+// postgresStore keeps customers in the "customers" table, queries use the
+// current pool so they always run with the latest SVID
+type postgresStore struct {
+	db *database
+}
+
+func newPostgresStore(db *database) *postgresStore {
+	return &postgresStore{db: db}
+}
+
+// customerFilterClause matches $1 and $2 against name and address
+const customerFilterClause = `WHERE ($1 = '' OR strpos(lower("name"), lower($1)) > 0)
+	AND ($2 = '' OR strpos(lower("address"), lower($2)) > 0)`
+
+func (s *postgresStore) List(ctx context.Context, filter CustomerFilter) ([]*Customer, int, error) {
+	var customers []*Customer
+	var total int
+	err := s.db.do(func(db *sql.DB) error {
+		count := `SELECT count(*) FROM "customers" ` + customerFilterClause
+		if err := db.QueryRowContext(ctx, count, filter.Name, filter.Address).Scan(&total); err != nil {
+			return fmt.Errorf("error counting customers: %w", err)
+		}
+
+		query := `SELECT "id", "name", "address" FROM "customers" ` + customerFilterClause +
+			` ORDER BY "id" LIMIT $3 OFFSET $4`
+		rows, err := db.QueryContext(ctx, query, filter.Name, filter.Address, filter.Limit, filter.Offset)
+		if err != nil {
+			return fmt.Errorf("error executing query: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			customer := &Customer{}
+			if err := rows.Scan(&customer.ID, &customer.Name, &customer.Address); err != nil {
+				return fmt.Errorf("error retrieving customer: %w", err)
+			}
+			customers = append(customers, customer)
+		}
+
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating over rows: %w", err)
+		}
+		return nil
+	})
+	return customers, total, err
+}
+
+func (s *postgresStore) Get(ctx context.Context, id int64) (*Customer, error) {
+	customer := &Customer{}
+	err := s.db.do(func(db *sql.DB) error {
+		query := `SELECT "id", "name", "address" FROM "customers" WHERE "id" = $1`
+		return db.QueryRowContext(ctx, query, id).Scan(&customer.ID, &customer.Name, &customer.Address)
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, errCustomerNotFound
+	case err != nil:
+		return nil, fmt.Errorf("error retrieving customer: %w", err)
+	}
+	return customer, nil
+}
+
+func (s *postgresStore) Insert(ctx context.Context, customer *Customer) error {
+	return s.db.do(func(db *sql.DB) error {
+		insert := `INSERT INTO "customers"("name", "address") VALUES($1, $2) RETURNING "id"`
+		if err := db.QueryRowContext(ctx, insert, customer.Name, customer.Address).Scan(&customer.ID); err != nil {
+			return fmt.Errorf("error inserting customer: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *postgresStore) Update(ctx context.Context, customer *Customer) error {
+	return s.db.do(func(db *sql.DB) error {
+		update := `UPDATE "customers" SET "name" = $2, "address" = $3 WHERE "id" = $1`
+		result, err := db.ExecContext(ctx, update, customer.ID, customer.Name, customer.Address)
+		if err != nil {
+			return fmt.Errorf("error updating customer: %w", err)
+		}
+		return expectAffected(result)
+	})
+}
+
+func (s *postgresStore) Delete(ctx context.Context, id int64) error {
+	return s.db.do(func(db *sql.DB) error {
+		result, err := db.ExecContext(ctx, `DELETE FROM "customers" WHERE "id" = $1`, id)
+		if err != nil {
+			return fmt.Errorf("error deleting customer: %w", err)
+		}
+		return expectAffected(result)
+	})
+}
+
+// expectAffected returns errCustomerNotFound when result did not change any row
+func expectAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error reading affected rows: %w", err)
+	}
+	if affected == 0 {
+		return errCustomerNotFound
+	}
+	return nil
+}
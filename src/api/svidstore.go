@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// svidStore keeps the credential files and the database connections in
+// sync with every X509-SVID received from the Workload API
+type svidStore struct {
+	// writer is nil when credential files are disabled
+	writer *credentialWriter
+	// db is nil when customers are kept in memory
+	db *database
+
+	// serial of the last stored SVID
+	serial string
+}
+
+// update is called by the X509 updater before the SVID is observed
+func (s *svidStore) update(x509SVID *x509svid.SVID, x509Bundle *x509bundle.Bundle) error {
+	if s.writer != nil {
+		if err := s.writeCredentials(x509SVID, x509Bundle); err != nil {
+			return err
+		}
+	}
+
+	// Bundle updates do not require new connections
+	serial := x509SVID.Certificates[0].SerialNumber.String()
+	if s.db != nil && s.serial != "" && s.serial != serial {
+		s.db.rotate()
+	}
+	s.serial = serial
+
+	return nil
+}
+
+func (s *svidStore) writeCredentials(x509SVID *x509svid.SVID, x509Bundle *x509bundle.Bundle) error {
+	cert, key, err := x509SVID.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marhal SVID: %w", err)
+	}
+
+	bundlePem, err := x509Bundle.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to get marshal bundle: %w", err)
+	}
+
+	// SVID, key and bundle are swapped in together, the database takes the
+	// certificate and key from the same version, see fileConnector
+	if err := s.writer.writeSVID(cert, key, bundlePem); err != nil {
+		return fmt.Errorf("failed to write credentials on disk: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"rotation/service"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxBodySize is the largest request body accepted, in bytes
+	maxBodySize = 16 << 10
+	// maxNameLength matches the size of the "name" column
+	maxNameLength = 40
+	// maxAddressLength is the longest address accepted, in characters
+	maxAddressLength = 200
+)
+
+// customerRequest is the body of create, update and patch requests, fields
+// are nil when they are not present
+type customerRequest struct {
+	Name    *string `json:"name"`
+	Address *string `json:"address"`
+}
+
+// validate trims the customer fields and verifies their length, fields are
+// only required when partial is false
+func (c *customerRequest) validate(partial bool) *service.RequestError {
+	var details []service.FieldError
+	check := func(field string, value *string, maxLength int) {
+		switch {
+		case value == nil:
+			if !partial {
+				details = append(details, service.FieldError{Field: field, Message: "is required"})
+			}
+		case strings.TrimSpace(*value) == "":
+			details = append(details, service.FieldError{Field: field, Message: "must not be empty"})
+		case utf8.RuneCountInString(strings.TrimSpace(*value)) > maxLength:
+			details = append(details, service.FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", maxLength)})
+		default:
+			*value = strings.TrimSpace(*value)
+		}
+	}
+	check("name", c.Name, maxNameLength)
+	check("address", c.Address, maxAddressLength)
+
+	if len(details) > 0 {
+		return service.InvalidFields(details...)
+	}
+	return nil
+}
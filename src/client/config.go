@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+type config struct {
+	// Trust domains federated with the client trust domain, upstream
+	// servers must belong to one of them or to the client trust domain
+	FederatedTrustDomains []string          `hcl:"federated_trust_domains,optional"`
+	Upstreams             []*upstreamConfig `hcl:"upstream,block"`
+
+	// Client trust domain followed by the federated ones
+	trustDomains []spiffeid.TrustDomain
+}
+
+// upstreamConfig declares a service rendered in the page
+type upstreamConfig struct {
+	Name string `hcl:"name,label"`
+	// Base URL of the service, e.g. "https://api.api-ns.svc.cluster.local:9001"
+	URL string `hcl:"url"`
+	// Path requested to get the items
+	Path string `hcl:"path"`
+	// Expected server SPIFFE ID
+	ServerID string `hcl:"server_id,optional"`
+	// List of allowed server SPIFFE IDs
+	ServerIDs []string `hcl:"server_ids,optional"`
+	// Expected server trust domain
+	ServerTrustDomain string `hcl:"server_trust_domain,optional"`
+	// Regular expression matched against the path of the server SPIFFE ID,
+	// it can be combined with ServerTrustDomain
+	ServerPathPattern string `hcl:"server_path_pattern,optional"`
+	// Audience of the JWT-SVID sent to the service
+	Audience string `hcl:"audience"`
+	// Request timeout, e.g. "5s"
+	Timeout string `hcl:"timeout,optional"`
+
+	Schema *schemaConfig `hcl:"schema,block"`
+
+	timeout time.Duration
+	server  *serverPolicy
+}
+
+// schemaConfig describes the response, a JSON object with a list of items
+type schemaConfig struct {
+	// Field of the response holding the items
+	Items string `hcl:"items"`
+	// Item fields rendered as columns
+	Columns []string `hcl:"columns"`
+}
+
+// loadConfig parses and validates the configuration of a client that
+// belongs to td
+func loadConfig(path string, td spiffeid.TrustDomain) (*config, error) {
+	c := new(config)
+	if err := hclsimple.DecodeFile(path, nil, c); err != nil {
+		return nil, fmt.Errorf("error parsing configuration file: %w", err)
+	}
+
+	c.trustDomains = []spiffeid.TrustDomain{td}
+	for _, rawTD := range c.FederatedTrustDomains {
+		federated, err := spiffeid.TrustDomainFromString(rawTD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid federated trust domain %q: %w", rawTD, err)
+		}
+		if slices.Contains(c.trustDomains, federated) {
+			return nil, fmt.Errorf("federated trust domain %q is repeated or is the client trust domain", rawTD)
+		}
+		c.trustDomains = append(c.trustDomains, federated)
+	}
+
+	names := make(map[string]bool)
+	for _, u := range c.Upstreams {
+		if names[u.Name] {
+			return nil, fmt.Errorf("upstream %q is declared more than once", u.Name)
+		}
+		names[u.Name] = true
+
+		if err := u.validate(c.trustDomains); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", u.Name, err)
+		}
+	}
+
+	return c, nil
+}
+
+func (u *upstreamConfig) validate(trusted []spiffeid.TrustDomain) error {
+	parsed, err := url.Parse(u.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("url %q must be an absolute https URL", u.URL)
+	}
+	if u.Audience == "" {
+		return errors.New("audience is required")
+	}
+
+	u.timeout = 10 * time.Second
+	if u.Timeout != "" {
+		if u.timeout, err = time.ParseDuration(u.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+
+	if u.server, err = u.serverPolicy(trusted); err != nil {
+		return err
+	}
+	if u.server.allowAny {
+		log.Warn("Upstream server identity is only verified against trusted trust domains", "upstream", u.Name)
+	}
+
+	if u.Schema == nil || u.Schema.Items == "" || len(u.Schema.Columns) == 0 {
+		return errors.New("schema with items and columns is required")
+	}
+
+	return nil
+}
+
+// serverPolicy parses the server identity settings. Only one of server_id,
+// server_ids and server_trust_domain can be set, server_path_pattern can be
+// used alone or together with server_trust_domain. Servers must always belong
+// to one of the trusted trust domains.
+func (u *upstreamConfig) serverPolicy(trusted []spiffeid.TrustDomain) (*serverPolicy, error) {
+	set := 0
+	for _, isSet := range []bool{u.ServerID != "", len(u.ServerIDs) > 0, u.ServerTrustDomain != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("server_id, server_ids and server_trust_domain are mutually exclusive")
+	}
+	if u.ServerPathPattern != "" && (u.ServerID != "" || len(u.ServerIDs) > 0) {
+		return nil, errors.New("server_path_pattern can only be combined with server_trust_domain")
+	}
+
+	p := &serverPolicy{trusted: trusted}
+	switch {
+	case u.ServerID != "":
+		id, err := spiffeid.FromString(u.ServerID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_id: %w", err)
+		}
+		if !slices.ContainsFunc(trusted, id.MemberOf) {
+			return nil, fmt.Errorf("server_id %q does not belong to a trusted trust domain", id)
+		}
+		p.ids = []spiffeid.ID{id}
+	case len(u.ServerIDs) > 0:
+		for _, rawID := range u.ServerIDs {
+			id, err := spiffeid.FromString(rawID)
+			if err != nil {
+				return nil, fmt.Errorf("invalid server_ids entry %q: %w", rawID, err)
+			}
+			if !slices.ContainsFunc(trusted, id.MemberOf) {
+				return nil, fmt.Errorf("server_ids entry %q does not belong to a trusted trust domain", id)
+			}
+			p.ids = append(p.ids, id)
+		}
+	case u.ServerTrustDomain != "":
+		td, err := spiffeid.TrustDomainFromString(u.ServerTrustDomain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_trust_domain: %w", err)
+		}
+		if !slices.Contains(trusted, td) {
+			return nil, fmt.Errorf("server_trust_domain %q is not trusted", td)
+		}
+		p.trustDomain = td
+	}
+
+	if u.ServerPathPattern != "" {
+		pattern, err := regexp.Compile(u.ServerPathPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_path_pattern: %w", err)
+		}
+		p.pathPattern = pattern
+	}
+
+	p.allowAny = len(p.ids) == 0 && p.trustDomain.IsZero() && p.pathPattern == nil
+	return p, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestUpstreamConfigValidate(t *testing.T) {
+	trusted := []spiffeid.TrustDomain{spiffeid.RequireTrustDomainFromString("cluster.demo")}
+	newConfig := func(modify func(u *upstreamConfig)) *upstreamConfig {
+		u := &upstreamConfig{
+			Name:              "api",
+			URL:               "https://api.api-ns.svc.cluster.local:9001",
+			Path:              "/customers",
+			ServerTrustDomain: "cluster.demo",
+			Audience:          "aud",
+			Schema:            &schemaConfig{Items: "customers", Columns: []string{"id", "name"}},
+		}
+		if modify != nil {
+			modify(u)
+		}
+		return u
+	}
+
+	tests := []struct {
+		name        string
+		config      *upstreamConfig
+		wantTimeout time.Duration
+		wantErr     string
+	}{
+		{
+			name:        "defaults",
+			config:      newConfig(nil),
+			wantTimeout: 10 * time.Second,
+		},
+		{
+			name:        "timeout",
+			config:      newConfig(func(u *upstreamConfig) { u.Timeout = "2s" }),
+			wantTimeout: 2 * time.Second,
+		},
+		{
+			name:    "empty audience",
+			config:  newConfig(func(u *upstreamConfig) { u.Audience = "" }),
+			wantErr: "audience is required",
+		},
+		{
+			name:    "plain HTTP",
+			config:  newConfig(func(u *upstreamConfig) { u.URL = "http://api.api-ns.svc.cluster.local:9001" }),
+			wantErr: "must be an absolute https URL",
+		},
+		{
+			name:    "untrusted server trust domain",
+			config:  newConfig(func(u *upstreamConfig) { u.ServerTrustDomain = "other.demo" }),
+			wantErr: `server_trust_domain "other.demo" is not trusted`,
+		},
+		{
+			name: "server ID and trust domain",
+			config: newConfig(func(u *upstreamConfig) {
+				u.ServerID = "spiffe://cluster.demo/ns/api-ns/sa/default"
+			}),
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:    "missing schema",
+			config:  newConfig(func(u *upstreamConfig) { u.Schema = nil }),
+			wantErr: "schema with items and columns is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate(trusted)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.config.timeout != tt.wantTimeout {
+				t.Errorf("timeout = %v, want %v", tt.config.timeout, tt.wantTimeout)
+			}
+		})
+	}
+}
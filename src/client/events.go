@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rotation"
+	"time"
+)
+
+// keepAliveInterval is how often a comment is sent to idle streams, so
+// proxies do not close them
+const keepAliveInterval = 30 * time.Second
+
+// eventSource notifies rotation events, it is implemented by
+// rotation.Tracker
+type eventSource interface {
+	Subscribe() (<-chan rotation.Event, func())
+}
+
+// eventsHandler streams rotation events using Server-Sent Events. Every
+// X509-SVID, X.509 bundle and JWT bundle change is sent as a "rotation"
+// event with the JSON encoded rotation.Event as data.
+func eventsHandler(tracker eventSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := tracker.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		log.Info("Rotation event stream opened", "remote_addr", r.RemoteAddr)
+		defer log.Info("Rotation event stream closed", "remote_addr", r.RemoteAddr)
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case e := <-events:
+				data, err := json.Marshal(e)
+				if err != nil {
+					log.Error("Failed to encode rotation event", "error", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: rotation\ndata: %s\n\n", data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
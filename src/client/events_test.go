@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"rotation"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// countingEventSource counts the open subscriptions of a tracker
+type countingEventSource struct {
+	tracker *rotation.Tracker
+
+	mu   sync.Mutex
+	open int
+}
+
+func (s *countingEventSource) Subscribe() (<-chan rotation.Event, func()) {
+	s.mu.Lock()
+	s.open++
+	s.mu.Unlock()
+
+	events, unsubscribe := s.tracker.Subscribe()
+	return events, func() {
+		unsubscribe()
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+	}
+}
+
+func (s *countingEventSource) subscriptions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open
+}
+
+// flushRecorder sends the body written since the previous flush on every
+// flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (r *flushRecorder) Flush() {
+	body := r.Body.String()
+	r.Body.Reset()
+	r.flushed <- body
+}
+
+func (r *flushRecorder) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case body := <-r.flushed:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("response was not flushed")
+		return ""
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	tracker := rotation.NewTracker(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	source := &countingEventSource{tracker: tracker}
+	td := spiffeid.RequireTrustDomainFromString("cluster.demo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 10)}
+	done := make(chan struct{})
+	go func() {
+		eventsHandler(source)(rec, httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	// Headers are flushed before any event
+	if body := rec.next(t); body != "" {
+		t.Fatalf("body = %q before any event, want none", body)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("content type = %q, want text/event-stream", contentType)
+	}
+	if source.subscriptions() != 1 {
+		t.Fatalf("%d subscriptions, want 1", source.subscriptions())
+	}
+
+	// Every event is sent and flushed on its own
+	for _, keyID := range []string{"a1", "b2"} {
+		tracker.ObserveX509Bundle(x509bundle.FromX509Authorities(td, []*x509.Certificate{
+			{SubjectKeyId: []byte{keyID[0], keyID[1]}},
+		}))
+		body := rec.next(t)
+		data, ok := strings.CutPrefix(body, "event: rotation\ndata: ")
+		if !ok || !strings.HasSuffix(data, "\n\n") || strings.Count(body, "\n") != 3 {
+			t.Fatalf("body = %q, want a single rotation event", body)
+		}
+		var e rotation.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != rotation.X509AuthorityAdded || e.New != rotation.KeyID([]byte(keyID)) {
+			t.Errorf("event = %+v, want %s added", e, rotation.KeyID([]byte(keyID)))
+		}
+	}
+
+	// The subscription is removed when the client disconnects
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client disconnected")
+	}
+	if source.subscriptions() != 0 {
+		t.Fatalf("%d subscriptions after the client disconnected, want 0", source.subscriptions())
+	}
+}
+
+func TestEventsHandlerMethod(t *testing.T) {
+	source := &countingEventSource{tracker: rotation.NewTracker(slog.New(slog.NewTextHandler(io.Discard, nil)))}
+	rec := httptest.NewRecorder()
+	eventsHandler(source)(rec, httptest.NewRequest(http.MethodPost, "/events", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if source.subscriptions() != 0 {
+		t.Errorf("%d subscriptions, want 0", source.subscriptions())
+	}
+}
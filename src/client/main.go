@@ -2,122 +2,42 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"rotation"
+	"rotation/service"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spiffe/go-spiffe/v2/logger"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
-	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
-	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 const (
-	productAPIURL = "https://host.docker.internal:9443/"
-	port          = 8080
+	port = 8080
 )
 
 var (
-	x509Source         = &workloadapi.X509Source{}
-	bundleSource       = &workloadapi.BundleSource{}
-	socketPathFlag     = flag.String("agentSocketPath", "/run/spire/sockets/agent.sock", "Agent named pipe name")
-	customerAPIURLFlag = flag.String("customerAPIURL", "https://api.api-ns.svc.cluster.local:9001", "Agent named pipe name")
-	log                = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	trustDomain         spiffeid.TrustDomain
+	x509Source          = &workloadapi.X509Source{}
+	bundleSource        = &workloadapi.BundleSource{}
+	socketPathFlag      = flag.String("agentSocketPath", "/run/spire/sockets/agent.sock", "Agent named pipe name")
+	configFilePath      = flag.String("config", "client.hcl", "Path to configuration file")
+	trustDomainFlag     = flag.String("trustDomain", "cluster.demo", "Trust domain of the client and its upstreams")
+	refreshFractionFlag = flag.Float64("jwtRefreshFraction", 0.5, "Fraction of a JWT-SVID lifetime after which it is refreshed in the background")
+	adminPortFlag       = flag.Int("adminPort", 8081, "Port for status endpoints, disabled when 0")
+	taintedFlag         = flag.String("taintedAuthorities", "", "Comma separated list of authority key IDs that are expected to be revoked")
+	log                 = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 )
 
-type CustomersResponse struct {
-	Customers []*Customer `json:"customers"`
-}
-
-type Customer struct {
-	Name    string `json:"name"`
-	Address string `json:"address"`
-}
-
-type ProductsResponse struct {
-	Products []*Product `json:"products"`
-}
-
-type Product struct {
-	Name  string `json:"name"`
-	Stock int    `json:"stock"`
-}
-
-func getCustomers(jwtSVID *jwtsvid.SVID) ([]*Customer, error) {
-	tlsConfig := tlsconfig.MTLSClientConfig(x509Source, bundleSource, tlsconfig.AuthorizeAny())
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-	}
-	customerAPIURL := *customerAPIURLFlag
-
-	req, err := http.NewRequest("GET", customerAPIURL+"/customers", nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", jwtSVID.Marshal()))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to %q: %v", customerAPIURL, err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-
-	listResp := new(CustomersResponse)
-	if err := json.NewDecoder(resp.Body).Decode(listResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return listResp.Customers, nil
-}
-
-func getProducts(jwtSVID *jwtsvid.SVID) ([]*Product, error) {
-	serverID := spiffeid.RequireFromString("spiffe://example.org/products-api")
-	tlsConfig := tlsconfig.MTLSClientConfig(x509Source, bundleSource, tlsconfig.AuthorizeID(serverID))
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-	}
-
-	req, err := http.NewRequest("GET", productAPIURL+"/products", nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", jwtSVID.Marshal()))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to %q: %v", productAPIURL, err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-
-	listResp := new(ProductsResponse)
-	if err := json.NewDecoder(resp.Body).Decode(listResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return listResp.Products, nil
-}
-
 type handler struct {
-	jwtSource *workloadapi.JWTSource
+	upstreams []*upstream
+	tracker   *rotation.Tracker
 }
 
 func (h *handler) indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -126,32 +46,24 @@ func (h *handler) indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch JWT SVID and add it to `Authorization` header,
-	// It is possible to fetch JWT SVID using `workloadapi.FetchJWTSVID`
-	svid, err := h.jwtSource.FetchJWTSVID(context.Background(), jwtsvid.Params{
-		Audience: "aud",
-	})
-	if err != nil {
-		log.Error("Failed to fetch JWT SVID", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	}
-
-	log.Info("JWT SVID fetched", "token", svid.Marshal())
-
-	customers, customersErr := getCustomers(svid)
-	if customersErr != nil {
-		log.Error("Failed to get customers", "error", customersErr)
+	tables := make([]*table, len(h.upstreams))
+	var wg sync.WaitGroup
+	for i, u := range h.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tables[i] = u.fetchTable(r.Context())
+			// Server authorization failures are logged by the upstream
+			if tables[i].Err != nil && !tables[i].Unauthorized {
+				log.Error("Failed to get upstream items", "upstream", u.name, "error", tables[i].Err)
+			}
+		}()
 	}
-	// products, productsErr := getProducts(svid)
-	// if productsErr != nil {
-	// log.Error("Failed to get products", "error", productsErr)
-	// }
+	wg.Wait()
 
 	page.Execute(w, map[string]interface{}{
-		"Customers":    customers,
-		"CustomersErr": customersErr,
-		// "Products":     products,
-		// "ProductsErr":  productsErr,
+		"Upstreams":   tables,
+		"Rotation":    h.tracker.Snapshot(),
 		"LastUpdated": time.Now(),
 	})
 }
@@ -164,34 +76,43 @@ func healthy(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func subjectKeyIDToString(ski []byte) string {
-	serialHex := fmt.Sprintf("%x", ski)
-	if len(serialHex)%2 == 1 {
-		serialHex = "0" + serialHex
+// validateFlags verifies identity related flags
+func validateFlags() error {
+	var err error
+	if trustDomain, err = spiffeid.TrustDomainFromString(*trustDomainFlag); err != nil {
+		return fmt.Errorf("invalid trust domain %q: %w", *trustDomainFlag, err)
 	}
-
-	return serialHex
+	if *refreshFractionFlag <= 0 || *refreshFractionFlag > 1 {
+		return fmt.Errorf("JWT refresh fraction must be in (0, 1], got %v", *refreshFractionFlag)
+	}
+	return nil
 }
 
 func main() {
 	flag.Parse()
+	if err := validateFlags(); err != nil {
+		log.Error("Invalid flags", "error", err)
+		os.Exit(1)
+	}
+
+	log.Info("Reading configuration file", "path", *configFilePath)
+	c, err := loadConfig(*configFilePath, trustDomain)
+	if err != nil {
+		log.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	socketPath := "unix://" + *socketPathFlag
 	clientOptions := workloadapi.WithClientOptions(workloadapi.WithAddr(socketPath),
 		workloadapi.WithLogger(logger.Std))
-	var err error
 	x509Source, err = workloadapi.NewX509Source(ctx, clientOptions)
 	if err != nil {
 		log.Error("Failed to create X509Source", "error", err)
 		os.Exit(1)
 	}
 	defer x509Source.Close()
-	svid, err := x509Source.GetX509SVID()
-	if err == nil {
-		log.Info("SVID found", "spiffe_id", svid.ID.String())
-	}
 
 	bundleSource, err = workloadapi.NewBundleSource(ctx, clientOptions)
 	if err != nil {
@@ -208,40 +129,102 @@ func main() {
 	}
 	defer jwtSource.Close()
 
-	h := &handler{
-		jwtSource: jwtSource,
+	tracker := rotation.NewTracker(log)
+	var tainted []string
+	if *taintedFlag != "" {
+		tainted = strings.Split(*taintedFlag, ",")
+	}
+	taint := rotation.NewTaintDetector(tainted, log)
+	metrics := rotation.NewMetrics()
+	tokens := newTokenCache(jwtSource, tracker, *refreshFractionFlag)
+	metrics.MustRegister(tokens.requests)
+	log.Info("Trusted trust domains", "trust_domain", trustDomain, "federated", c.FederatedTrustDomains)
+	rotation.ObserveTrustDomains(bundleSource, c.trustDomains, tracker, metrics, taint)
+	h := &handler{tracker: tracker}
+	for _, upstreamConfig := range c.Upstreams {
+		h.upstreams = append(h.upstreams, newUpstream(upstreamConfig, tokens))
+	}
+
+	observeX509 := func() {
+		x509SVID, err := x509Source.GetX509SVID()
+		if err != nil {
+			log.Error("Failed to get X509SVID", "error", err)
+			return
+		}
+		log.Info("SVID found", "spiffe_id", x509SVID.ID.String(),
+			"subject_key_id", rotation.KeyID(x509SVID.Certificates[0].SubjectKeyId),
+			"authority_key_id", rotation.KeyID(x509SVID.Certificates[0].AuthorityKeyId))
+		bundle, err := x509Source.GetX509BundleForTrustDomain(x509SVID.ID.TrustDomain())
+		if err != nil {
+			log.Error("Failed to get bundle for trust domain", "error", err)
+			return
+		}
+		tracker.ObserveX509(x509SVID, bundle)
+		taint.CheckX509(x509SVID, bundle)
+		metrics.ObserveX509(x509SVID, bundle)
+	}
+	observeJWT := func() {
+		bundle, err := jwtSource.GetJWTBundleForTrustDomain(trustDomain)
+		if err != nil {
+			log.Error("Failed to get JWT bundle for trust domain", "error", err)
+			return
+		}
+		tracker.ObserveJWTBundle(bundle)
+		metrics.ObserveJWTBundle(bundle)
+
+		// Any audience works, all JWT-SVIDs are signed with the same key
+		if len(h.upstreams) == 0 {
+			return
+		}
+		jwtSVID, err := tokens.fetch(ctx, h.upstreams[0].audience)
+		if err != nil {
+			log.Error("Failed to fetch JWT SVID", "error", err)
+			return
+		}
+		taint.CheckJWT(jwtSVID, bundle)
 	}
 
+	// Sources are not notified of the SVIDs received while they start
+	observeX509()
+	observeJWT()
+
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-x509Source.Updated():
-				x509SVID, err := x509Source.GetX509SVID()
-				if err != nil {
-					log.Error("Failed to get X509SVID", "error", err)
-					continue
-				}
-				log.Info("SVID found", "spiffe_id", x509SVID.ID.String(),
-					"subject_key_id", subjectKeyIDToString(x509SVID.Certificates[0].SubjectKeyId),
-					"authority_key_id", subjectKeyIDToString(x509SVID.Certificates[0].AuthorityKeyId))
-				bundle, err := x509Source.GetX509BundleForTrustDomain(x509SVID.ID.TrustDomain())
-				if err != nil {
-					log.Error("Failed to get bundle for trust domain", "error", err)
-				}
-				for _, authority := range bundle.X509Authorities() {
-					log.Info("Authority recieved", "subject_key_id", subjectKeyIDToString(authority.SubjectKeyId))
+				metrics.IncUpdates("x509")
+				tracker.RecordUpdate("x509")
+				// Following requests must handshake with the new SVID
+				for _, u := range h.upstreams {
+					u.rotate()
 				}
+				observeX509()
+			case <-bundleSource.Updated():
+				metrics.IncUpdates("bundle")
+				tracker.RecordUpdate("bundle")
+				rotation.ObserveTrustDomains(bundleSource, c.trustDomains, tracker, metrics, taint)
+			case <-jwtSource.Updated():
+				metrics.IncUpdates("jwt")
+				tracker.RecordUpdate("jwt")
+				// New JWT authorities may have been activated
+				tokens.invalidate()
+				observeJWT()
 			}
 		}
 	}()
 
+	if *adminPortFlag != 0 {
+		go service.ServeAdmin(*adminPortFlag, service.NewAdminHandler(taint, metrics, tracker), log)
+	}
+
 	server := &http.Server{
 		Addr: fmt.Sprintf(":%d", port),
 	}
 	http.HandleFunc("/", h.indexHandler)
 	http.HandleFunc("/healthy", healthy)
+	http.HandleFunc("/events", eventsHandler(tracker))
 
 	log.Info("Webapp listening on port", "port", port)
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   map[string]string
+		wantTD  string
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			wantTD: "cluster.demo",
+		},
+		{
+			name:   "trust domain",
+			flags:  map[string]string{"trustDomain": "client.demo"},
+			wantTD: "client.demo",
+		},
+		{
+			name:    "invalid trust domain",
+			flags:   map[string]string{"trustDomain": "Client Demo"},
+			wantErr: `invalid trust domain "Client Demo"`,
+		},
+		{
+			name:    "empty trust domain",
+			flags:   map[string]string{"trustDomain": ""},
+			wantErr: `invalid trust domain ""`,
+		},
+		{
+			name:   "refresh at expiry",
+			flags:  map[string]string{"jwtRefreshFraction": "1"},
+			wantTD: "cluster.demo",
+		},
+		{
+			name:    "zero refresh fraction",
+			flags:   map[string]string{"jwtRefreshFraction": "0"},
+			wantErr: "JWT refresh fraction must be in (0, 1], got 0",
+		},
+		{
+			name:    "refresh fraction over 1",
+			flags:   map[string]string{"jwtRefreshFraction": "1.5"},
+			wantErr: "JWT refresh fraction must be in (0, 1], got 1.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.flags {
+				f := flag.Lookup(name)
+				defaultValue := f.DefValue
+				if err := f.Value.Set(value); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = f.Value.Set(defaultValue) })
+			}
+
+			err := validateFlags()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trustDomain.String() != tt.wantTD {
+				t.Errorf("trust domain = %q, want %q", trustDomain, tt.wantTD)
+			}
+		})
+	}
+}
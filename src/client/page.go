@@ -1,12 +1,36 @@
 package main
 
-import "html/template"
+import (
+	"html/template"
+	"strings"
+)
 
 const markup = `
 <!DOCTYPE html>
 <html>
     <head>
-
+        <script>
+            // Reload the page content when a rotation event is received,
+            // events usually come in bursts so they are coalesced
+            let pending = null;
+            function refresh() {
+                pending = null;
+                fetch(window.location.href)
+                    .then(response => response.text())
+                    .then(text => {
+                        const doc = new DOMParser().parseFromString(text, "text/html");
+                        document.body.replaceWith(doc.body);
+                    })
+                    .catch(err => console.error("Failed to refresh page", err));
+            }
+            const events = new EventSource("/events");
+            events.addEventListener("rotation", event => {
+                console.log("Rotation event", JSON.parse(event.data));
+                if (pending === null) {
+                    pending = setTimeout(refresh, 1000);
+                }
+            });
+        </script>
     </head>
     <body>
         <style>
@@ -30,59 +54,176 @@ const markup = `
             .error {
                 color: red;
             }
+            .unauthorized {
+                color: darkorange;
+                font-weight: bold;
+            }
+            .rotation {
+                margin-top: 2em;
+                padding: 0 1em 1em;
+                border: 1px solid gray;
+            }
+            .highlight {
+                background-color: yellow;
+                font-weight: bold;
+            }
         </style>
-        {{if .CustomersErr}}
-	<div class="error">Customers service unavailable: {{.CustomersErr}}</div>
-        {{end}}
-      <!--
-        {{if .ProductsErr}}
-	<div class="error">Products service unavailable: {{.ProductsErr}}</div>
-        {{end}}
+        {{range .Upstreams}}
 	<div>
-	    <h1>Products</h1>
+	    <h1>{{title .Name}}</h1>
 	</div>
+        {{if .Unauthorized}}
+	<div class="unauthorized">{{title .Name}} server identity rejected, no request was sent: {{.Err}}</div>
+        {{else if .Rejected}}
+	<div class="error">
+	    {{title .Name}} rejected the request with {{.Rejected.StatusText}}{{with .Rejected.Code}} ({{.}}){{end}}{{with .Rejected.Message}}: {{.}}{{end}}
+	    {{with .Rejected.Details}}
+	    <ul>
+		{{range .}}<li>{{.Field}} {{.Message}}</li>{{end}}
+	    </ul>
+	    {{end}}
+	</div>
+        {{else if .Err}}
+	<div class="error">{{title .Name}} service unavailable: {{.Err}}</div>
+        {{else}}
         <table class="data-table">
-            <caption class="right">Last Updated: {{.LastUpdated.Format "Jan 2 15:04:05"}}</caption>
+            <caption class="right">Last Updated: {{$.LastUpdated.Format "Jan 2 15:04:05"}}</caption>
             <thead>
                 <tr>
-                    <th scope="col">Name</th>
-                    <th scope="col">Stock</th>
+                    {{range .Columns}}
+                    <th scope="col">{{title .}}</th>
+                    {{end}}
                 </tr>
             </thead>
 	    <tbody>
-		{{range .Products}}
+		{{range .Rows}}
                     <tr>
-                        <td scope="row">{{.Name}}</td>
-                        <td scope="row">{{.Stock}}</td>
+                        {{range .}}
+                        <td scope="row">{{.}}</td>
+                        {{end}}
                     </tr>
                 {{end}}
             </tbody>
         </table>
-      -->
-	<div>
-	    <h1>Customers</h1>
-	</div>
-        <table class="data-table">
-            <caption class="right">Last Updated: {{.LastUpdated.Format "Jan 2 15:04:05"}}</caption>
-            <thead>
-                <tr>
-                    <th scope="col">Name</th>
-                    <th scope="col">Address</th>
-                </tr>
-            </thead>
-	    <tbody>
-		{{range .Customers}}
+        {{end}}
+        {{end}}
+        {{with .Rotation}}
+        {{$authority := ""}}{{with .X509SVID}}{{$authority = .AuthorityKeyID}}{{end}}
+        {{$jwtKey := ""}}{{with .JWTSVID}}{{$jwtKey = .KeyID}}{{end}}
+        <div class="rotation">
+            <h1>Rotation</h1>
+            <h2>X509-SVID</h2>
+            {{with .X509SVID}}
+            <p>{{.SPIFFEID}}, serial {{.Serial}}, valid from {{.NotBefore.Format "Jan 2 15:04:05"}} to {{.NotAfter.Format "Jan 2 15:04:05"}}</p>
+            <table class="data-table">
+                <thead>
                     <tr>
-                        <td scope="row">{{.Name}}</td>
-                        <td scope="row">{{.Address}}</td>
+                        <th scope="col">Subject</th>
+                        <th scope="col">Subject Key ID</th>
+                        <th scope="col">Authority Key ID</th>
+                        <th scope="col">Expires</th>
                     </tr>
-                {{end}}
-            </tbody>
-        </table>
+                </thead>
+                <tbody>
+                    {{range $i, $cert := .Chain}}
+                    <tr>
+                        <td>{{.Subject}}</td>
+                        <td>{{.SubjectKeyID}}</td>
+                        <td{{if eq $i 0}} class="highlight"{{end}}>{{.AuthorityKeyID}}</td>
+                        <td>{{.NotAfter.Format "Jan 2 15:04:05"}}</td>
+                    </tr>
+                    {{end}}
+                </tbody>
+            </table>
+            {{else}}
+            <p>No X509-SVID received yet</p>
+            {{end}}
+            <h2>JWT-SVID</h2>
+            {{with .JWTSVID}}
+            <p>{{.SPIFFEID}}, signed with key <span class="highlight">{{.KeyID}}</span>, expires {{.Expiry.Format "Jan 2 15:04:05"}}</p>
+            {{else}}
+            <p>No JWT-SVID fetched yet</p>
+            {{end}}
+            {{range .Bundles}}
+            <h2>Bundle {{.TrustDomain}}</h2>
+            <table class="data-table">
+                <caption>X.509 authorities</caption>
+                <thead>
+                    <tr>
+                        <th scope="col">Key ID</th>
+                        <th scope="col">Subject</th>
+                        <th scope="col">Not After</th>
+                    </tr>
+                </thead>
+                <tbody>
+                    {{range .X509Authorities}}
+                    <tr{{if eq .KeyID $authority}} class="highlight"{{end}}>
+                        <td>{{.KeyID}}</td>
+                        <td>{{.Subject}}</td>
+                        <td>{{.NotAfter.Format "Jan 2 15:04:05"}}</td>
+                    </tr>
+                    {{end}}
+                </tbody>
+            </table>
+            <table class="data-table">
+                <caption>JWT authorities</caption>
+                <thead>
+                    <tr>
+                        <th scope="col">Key ID</th>
+                        <th scope="col">Algorithm</th>
+                    </tr>
+                </thead>
+                <tbody>
+                    {{range .JWTAuthorities}}
+                    <tr{{if eq .KeyID $jwtKey}} class="highlight"{{end}}>
+                        <td>{{.KeyID}}</td>
+                        <td>{{.Algorithm}}</td>
+                    </tr>
+                    {{end}}
+                </tbody>
+            </table>
+            {{end}}
+            <h2>Timeline</h2>
+            <table class="data-table">
+                <thead>
+                    <tr>
+                        <th scope="col">Time</th>
+                        <th scope="col">Event</th>
+                        <th scope="col">Trust Domain</th>
+                        <th scope="col">Old</th>
+                        <th scope="col">New</th>
+                    </tr>
+                </thead>
+                <tbody>
+                    {{range .Events}}
+                    <tr>
+                        <td>{{.Time.Format "Jan 2 15:04:05"}}</td>
+                        <td>{{.Type}}</td>
+                        <td>{{.TrustDomain}}</td>
+                        <td>{{.Old}}</td>
+                        <td>{{.New}}</td>
+                    </tr>
+                    {{else}}
+                    <tr>
+                        <td colspan="5" class="center">No rotation observed yet</td>
+                    </tr>
+                    {{end}}
+                </tbody>
+            </table>
+        </div>
+        {{end}}
     </body>
 </html>
 `
 
 var (
-	page, _ = template.New("quotes").Parse(markup)
+	page, _ = template.New("quotes").Funcs(template.FuncMap{"title": title}).Parse(markup)
 )
+
+// title capitalizes names and fields, e.g. "name" becomes "Name"
+func title(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// serverPolicy restricts the SPIFFE IDs an upstream server can present.
+// JWT-SVIDs are sent as bearer tokens, so they must never reach a server
+// that is not expected to receive them.
+type serverPolicy struct {
+	trusted     []spiffeid.TrustDomain
+	ids         []spiffeid.ID
+	trustDomain spiffeid.TrustDomain
+	pathPattern *regexp.Regexp
+	allowAny    bool
+}
+
+// check returns nil if id is allowed or the reason why it is not
+func (p *serverPolicy) check(id spiffeid.ID) error {
+	switch {
+	case !slices.ContainsFunc(p.trusted, id.MemberOf):
+		return fmt.Errorf("trust domain %q is not trusted", id.TrustDomain())
+	case len(p.ids) > 0 && !slices.Contains(p.ids, id):
+		return fmt.Errorf("expected %s", p)
+	case !p.trustDomain.IsZero() && !id.MemberOf(p.trustDomain):
+		return fmt.Errorf("expected a member of trust domain %q", p.trustDomain)
+	case p.pathPattern != nil && !p.pathPattern.MatchString(id.Path()):
+		return fmt.Errorf("expected a path matching %q", p.pathPattern)
+	}
+	return nil
+}
+
+// String describes the allowed server identities
+func (p *serverPolicy) String() string {
+	switch {
+	case p.allowAny:
+		return "any SPIFFE ID of a trusted trust domain"
+	case len(p.ids) == 1:
+		return fmt.Sprintf("%q", p.ids[0])
+	case len(p.ids) > 1:
+		ids := make([]string, 0, len(p.ids))
+		for _, id := range p.ids {
+			ids = append(ids, fmt.Sprintf("%q", id))
+		}
+		return "one of " + strings.Join(ids, ", ")
+	}
+
+	var parts []string
+	if !p.trustDomain.IsZero() {
+		parts = append(parts, fmt.Sprintf("member of %q", p.trustDomain))
+	}
+	if p.pathPattern != nil {
+		parts = append(parts, fmt.Sprintf("path matching %q", p.pathPattern))
+	}
+	return strings.Join(parts, " with ")
+}
+
+// authorizer adapts the policy to the TLS handshake. Rejections are returned
+// as *serverAuthorizationError, so callers can tell them apart from network
+// or certificate validation failures.
+func (p *serverPolicy) authorizer(upstream string) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		if err := p.check(id); err != nil {
+			return &serverAuthorizationError{
+				Upstream: upstream,
+				ServerID: id,
+				Reason:   err.Error(),
+			}
+		}
+		return nil
+	}
+}
+
+// serverAuthorizationError is returned when an upstream server presents an
+// SVID that is not allowed by its policy
+type serverAuthorizationError struct {
+	Upstream string
+	ServerID spiffeid.ID
+	Reason   string
+}
+
+func (e *serverAuthorizationError) Error() string {
+	return fmt.Sprintf("server %q is not authorized: %s", e.ServerID, e.Reason)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rotation"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// testCA issues X509-SVIDs for a trust domain
+type testCA struct {
+	td   spiffeid.TrustDomain
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, td string) *testCA {
+	t.Helper()
+	ca := &testCA{td: spiffeid.RequireTrustDomainFromString(td)}
+	ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: td},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	})
+	return ca
+}
+
+// issue signs template with the CA key, or self-signs it when the CA has no
+// certificate yet
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (ca *testCA) svid(t *testing.T, path string) *x509svid.SVID {
+	t.Helper()
+	id := spiffeid.RequireFromPath(ca.td, path)
+	cert, key := ca.issue(t, &x509.Certificate{
+		URIs:        []*url.URL{id.URL()},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+	return &x509svid.SVID{ID: id, Certificates: []*x509.Certificate{cert}, PrivateKey: key}
+}
+
+func (ca *testCA) bundle() *x509bundle.Bundle {
+	return x509bundle.FromX509Authorities(ca.td, []*x509.Certificate{ca.cert})
+}
+
+// TestServerAuthorization verifies JWT-SVIDs are only sent to servers
+// allowed by the upstream policy, and that rejections are rendered as such
+func TestServerAuthorization(t *testing.T) {
+	ca := newTestCA(t, "cluster.demo")
+	federated := newTestCA(t, "other.demo")
+	bundles := x509bundle.NewSet(ca.bundle(), federated.bundle())
+	trusted := []spiffeid.TrustDomain{ca.td}
+	clientSVID := ca.svid(t, "/ns/client-ns/sa/default")
+
+	tests := []struct {
+		name       string
+		serverSVID *x509svid.SVID
+		config     upstreamConfig
+		wantReason string
+	}{
+		{
+			name:       "expected server ID",
+			serverSVID: ca.svid(t, "/ns/api-ns/sa/default"),
+			config:     upstreamConfig{ServerID: "spiffe://cluster.demo/ns/api-ns/sa/default"},
+		},
+		{
+			name:       "server path pattern",
+			serverSVID: ca.svid(t, "/ns/api-ns/sa/default"),
+			config:     upstreamConfig{ServerTrustDomain: "cluster.demo", ServerPathPattern: "^/ns/api-ns/sa/[^/]+$"},
+		},
+		{
+			name:       "another server ID",
+			serverSVID: ca.svid(t, "/ns/products-ns/sa/default"),
+			config:     upstreamConfig{ServerID: "spiffe://cluster.demo/ns/api-ns/sa/default"},
+			wantReason: `expected "spiffe://cluster.demo/ns/api-ns/sa/default"`,
+		},
+		{
+			name:       "path not matching",
+			serverSVID: ca.svid(t, "/ns/products-ns/sa/default"),
+			config:     upstreamConfig{ServerTrustDomain: "cluster.demo", ServerPathPattern: "^/ns/api-ns/sa/[^/]+$"},
+			wantReason: `expected a path matching "^/ns/api-ns/sa/[^/]+$"`,
+		},
+		{
+			name:       "federated trust domain not trusted",
+			serverSVID: federated.svid(t, "/ns/api-ns/sa/default"),
+			config:     upstreamConfig{ServerPathPattern: "^/ns/api-ns/sa/[^/]+$"},
+			wantReason: `trust domain "other.demo" is not trusted`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"customers": [{"id": 1, "name": "Ana"}]}`))
+			}))
+			server.TLS = &tls.Config{
+				Certificates: []tls.Certificate{{
+					Certificate: [][]byte{tt.serverSVID.Certificates[0].Raw},
+					PrivateKey:  tt.serverSVID.PrivateKey,
+				}},
+				ClientAuth: tls.RequireAnyClientCert,
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			policy, err := tt.config.serverPolicy(trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := &upstream{
+				name:      "api",
+				baseURL:   server.URL,
+				path:      "/customers",
+				audience:  "api",
+				schema:    &schemaConfig{Items: "customers", Columns: []string{"id", "name"}},
+				tokens:    newTestTokenCache(newFakeJWTSource(time.Hour), 0.5),
+				tlsConfig: tlsconfig.MTLSClientConfig(clientSVID, bundles, policy.authorizer("api")),
+				timeout:   5 * time.Second,
+			}
+			u.client = u.newClient()
+
+			h := &handler{
+				upstreams: []*upstream{u},
+				tracker:   rotation.NewTracker(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			}
+			rec := httptest.NewRecorder()
+			h.indexHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			body := rec.Body.String()
+
+			table := u.fetchTable(context.Background())
+			if tt.wantReason == "" {
+				if table.Err != nil || table.Unauthorized {
+					t.Fatalf("error = %v, unauthorized = %v, want none", table.Err, table.Unauthorized)
+				}
+				if !strings.Contains(body, "<td scope=\"row\">Ana</td>") {
+					t.Errorf("page does not render the items:\n%s", body)
+				}
+				return
+			}
+
+			var authzErr *serverAuthorizationError
+			if !errors.As(table.Err, &authzErr) {
+				t.Fatalf("error = %v, want a server authorization error", table.Err)
+			}
+			if authzErr.ServerID != tt.serverSVID.ID || authzErr.Upstream != "api" || authzErr.Reason != tt.wantReason {
+				t.Errorf("error = %+v, want server %q rejected with %q", authzErr, tt.serverSVID.ID, tt.wantReason)
+			}
+			if !table.Unauthorized {
+				t.Error("table is not marked as unauthorized")
+			}
+			if n := requests.Load(); n != 0 {
+				t.Errorf("server received %d requests, want none", n)
+			}
+			if !strings.Contains(body, "Api server identity rejected, no request was sent") ||
+				!strings.Contains(body, "is not authorized") {
+				t.Errorf("page does not render the rejection:\n%s", body)
+			}
+		})
+	}
+}
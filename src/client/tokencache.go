@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"rotation"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+const (
+	refreshTimeout = 10 * time.Second
+	// expirySkew is the minimum lifetime left on a cached token, tokens
+	// closer to expiry could expire before the upstream validates them
+	expirySkew = 30 * time.Second
+)
+
+// jwtSVIDFetcher fetches JWT-SVIDs, it is implemented by
+// workloadapi.JWTSource
+type jwtSVIDFetcher interface {
+	FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error)
+}
+
+// tokenCache reuses JWT-SVIDs per audience. Once refreshFraction of a token
+// lifetime has elapsed the cached token is still returned, but a new one is
+// fetched in the background. All tokens are dropped when the JWT bundle is
+// updated, so activating a new JWT authority forces new tokens.
+type tokenCache struct {
+	source          jwtSVIDFetcher
+	tracker         *rotation.Tracker
+	refreshFraction float64
+	requests        *prometheus.CounterVec
+
+	mu      sync.Mutex
+	entries map[string]*tokenEntry
+	// generation is increased on every invalidation, so tokens fetched
+	// before it are not cached
+	generation uint64
+}
+
+type tokenEntry struct {
+	svid       *jwtsvid.SVID
+	refreshAt  time.Time
+	refreshing bool
+}
+
+func newTokenCache(source jwtSVIDFetcher, tracker *rotation.Tracker, refreshFraction float64) *tokenCache {
+	return &tokenCache{
+		source:          source,
+		tracker:         tracker,
+		refreshFraction: refreshFraction,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jwt_svid_cache_requests_total",
+			Help: "Number of JWT-SVID cache lookups, by result.",
+		}, []string{"result"}),
+		entries: make(map[string]*tokenEntry),
+	}
+}
+
+// fetch returns a cached JWT-SVID for audience or fetches a new one, tokens
+// expiring within expirySkew are not returned
+func (c *tokenCache) fetch(ctx context.Context, audience string) (*jwtsvid.SVID, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[audience]
+	if ok && time.Now().Add(expirySkew).Before(entry.svid.Expiry) {
+		if !entry.refreshing && !time.Now().Before(entry.refreshAt) {
+			entry.refreshing = true
+			go c.refresh(audience, c.generation)
+		}
+		c.mu.Unlock()
+
+		c.requests.WithLabelValues("hit").Inc()
+		return entry.svid, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	c.requests.WithLabelValues("miss").Inc()
+	return c.fetchAndStore(ctx, audience, generation)
+}
+
+// invalidate drops all cached tokens
+func (c *tokenCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*tokenEntry)
+	c.generation++
+	log.Info("JWT-SVID cache invalidated")
+}
+
+func (c *tokenCache) refresh(audience string, generation uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+
+	if _, err := c.fetchAndStore(ctx, audience, generation); err != nil {
+		log.Error("Failed to refresh JWT SVID", "audience", audience, "error", err)
+
+		c.mu.Lock()
+		if entry, ok := c.entries[audience]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *tokenCache) fetchAndStore(ctx context.Context, audience string, generation uint64) (*jwtsvid.SVID, error) {
+	svid, err := c.source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: audience})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWT SVID: %w", err)
+	}
+
+	keyID, _ := rotation.JWTKeyID(svid.Marshal())
+	log.Info("JWT SVID fetched", "audience", audience, "key_id", keyID, "expiry", svid.Expiry)
+	c.tracker.ObserveJWTSVID(svid)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.entries[audience] = &tokenEntry{
+			svid:      svid,
+			refreshAt: c.refreshTime(svid),
+		}
+	}
+
+	return svid, nil
+}
+
+// refreshTime returns when refreshFraction of the token lifetime has elapsed
+func (c *tokenCache) refreshTime(svid *jwtsvid.SVID) time.Time {
+	issuedAt := time.Now()
+	if iat, ok := svid.Claims["iat"].(float64); ok {
+		issuedAt = time.Unix(int64(iat), 0)
+	}
+
+	lifetime := svid.Expiry.Sub(issuedAt)
+	return issuedAt.Add(time.Duration(float64(lifetime) * c.refreshFraction))
+}
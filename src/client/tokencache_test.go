@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"rotation"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// fakeJWTSource returns tokens with the lifetime set by the test, issued
+// lifetime ago when issuedAgo is set
+type fakeJWTSource struct {
+	mu        sync.Mutex
+	calls     int
+	lifetime  time.Duration
+	issuedAgo time.Duration
+	// block, when set, holds fetches until it is closed
+	block chan struct{}
+	// fetched receives every fetched token
+	fetched chan *jwtsvid.SVID
+}
+
+func newFakeJWTSource(lifetime time.Duration) *fakeJWTSource {
+	return &fakeJWTSource{lifetime: lifetime, fetched: make(chan *jwtsvid.SVID, 10)}
+}
+
+func (s *fakeJWTSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	s.mu.Lock()
+	s.calls++
+	block, issuedAgo, lifetime := s.block, s.issuedAgo, s.lifetime
+	s.mu.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	issuedAt := time.Now().Add(-issuedAgo)
+	svid := &jwtsvid.SVID{
+		ID:       spiffeid.RequireFromString("spiffe://cluster.demo/ns/client-ns/sa/default"),
+		Audience: []string{params.Audience},
+		Expiry:   issuedAt.Add(lifetime),
+		Claims:   map[string]interface{}{"iat": float64(issuedAt.Unix())},
+	}
+	s.fetched <- svid
+	return svid, nil
+}
+
+func (s *fakeJWTSource) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *fakeJWTSource) set(f func(s *fakeJWTSource)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func newTestTokenCache(source *fakeJWTSource, refreshFraction float64) *tokenCache {
+	return newTokenCache(source, rotation.NewTracker(slog.New(slog.NewTextHandler(io.Discard, nil))), refreshFraction)
+}
+
+func (c *tokenCache) cached(audience string) *jwtsvid.SVID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[audience]; ok {
+		return entry.svid
+	}
+	return nil
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := counter.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func mustFetch(t *testing.T, c *tokenCache, audience string) *jwtsvid.SVID {
+	t.Helper()
+	svid, err := c.fetch(context.Background(), audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svid
+}
+
+func TestTokenCacheHitsAndMisses(t *testing.T) {
+	source := newFakeJWTSource(time.Hour)
+	c := newTestTokenCache(source, 0.5)
+
+	first := mustFetch(t, c, "api")
+	if second := mustFetch(t, c, "api"); second != first {
+		t.Fatal("cached token was not reused")
+	}
+	mustFetch(t, c, "products")
+
+	if calls := source.callCount(); calls != 2 {
+		t.Fatalf("source called %d times, want 2", calls)
+	}
+	if hits := counterValue(t, c.requests.WithLabelValues("hit")); hits != 1 {
+		t.Errorf("hits = %v, want 1", hits)
+	}
+	if misses := counterValue(t, c.requests.WithLabelValues("miss")); misses != 2 {
+		t.Errorf("misses = %v, want 2", misses)
+	}
+}
+
+func TestTokenCacheExpirySkew(t *testing.T) {
+	// Valid when cached, but within the skew
+	source := newFakeJWTSource(expirySkew / 2)
+	c := newTestTokenCache(source, 1)
+
+	first := mustFetch(t, c, "api")
+	if second := mustFetch(t, c, "api"); second == first {
+		t.Fatal("token about to expire was returned from the cache")
+	}
+	if misses := counterValue(t, c.requests.WithLabelValues("miss")); misses != 2 {
+		t.Errorf("misses = %v, want 2", misses)
+	}
+}
+
+func TestTokenCacheRefresh(t *testing.T) {
+	// Half of the lifetime has elapsed when the first token is fetched
+	source := newFakeJWTSource(2 * time.Hour)
+	source.issuedAgo = time.Hour
+	c := newTestTokenCache(source, 0.5)
+
+	first := mustFetch(t, c, "api")
+	<-source.fetched
+	source.set(func(s *fakeJWTSource) { s.issuedAgo = 0 })
+
+	// The cached token is returned while a new one is fetched
+	if svid := mustFetch(t, c, "api"); svid != first {
+		t.Fatal("token due for refresh was not returned")
+	}
+	var refreshed *jwtsvid.SVID
+	select {
+	case refreshed = <-source.fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("token was not refreshed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.cached("api") != refreshed {
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed token was not cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if svid := mustFetch(t, c, "api"); svid != refreshed {
+		t.Fatal("refreshed token was not returned")
+	}
+	// The refreshed token is not due for refresh
+	if calls := source.callCount(); calls != 2 {
+		t.Fatalf("source called %d times, want 2", calls)
+	}
+}
+
+func TestTokenCacheRefreshFraction(t *testing.T) {
+	// A quarter of the lifetime has elapsed, below the refresh fraction
+	source := newFakeJWTSource(4 * time.Hour)
+	source.issuedAgo = time.Hour
+	c := newTestTokenCache(source, 0.5)
+
+	mustFetch(t, c, "api")
+	mustFetch(t, c, "api")
+	time.Sleep(10 * time.Millisecond)
+	if calls := source.callCount(); calls != 1 {
+		t.Fatalf("source called %d times before the refresh fraction, want 1", calls)
+	}
+}
+
+func TestTokenCacheInvalidateDiscardsRefresh(t *testing.T) {
+	source := newFakeJWTSource(2 * time.Hour)
+	source.issuedAgo = time.Hour
+	c := newTestTokenCache(source, 0.5)
+
+	mustFetch(t, c, "api")
+	<-source.fetched
+
+	// The refresh is held by the source until the cache is invalidated
+	block := make(chan struct{})
+	source.set(func(s *fakeJWTSource) { s.block = block })
+	mustFetch(t, c, "api")
+	deadline := time.Now().Add(5 * time.Second)
+	for source.callCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("token was not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.invalidate()
+	source.set(func(s *fakeJWTSource) { s.block = nil })
+	close(block)
+
+	stale := <-source.fetched
+	// The token is stored right after it is fetched, give it time to be
+	// stored if it was going to be
+	time.Sleep(50 * time.Millisecond)
+	if c.cached("api") != nil {
+		t.Fatal("token fetched before the invalidation was cached")
+	}
+	if svid := mustFetch(t, c, "api"); svid == stale {
+		t.Fatal("token fetched before the invalidation was returned")
+	}
+}
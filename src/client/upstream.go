@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// upstream is a long-lived HTTP client for a single service. Connections are
+// reused between requests and every request carries a JWT-SVID for the
+// upstream audience. The client is replaced when the X509-SVID rotates, so
+// following requests handshake with the new certificate.
+type upstream struct {
+	name      string
+	baseURL   string
+	path      string
+	audience  string
+	schema    *schemaConfig
+	tokens    *tokenCache
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	client *http.Client
+}
+
+// newUpstream creates a client for an already validated config
+func newUpstream(c *upstreamConfig, tokens *tokenCache) *upstream {
+	u := &upstream{
+		name:      c.Name,
+		baseURL:   strings.TrimSuffix(c.URL, "/"),
+		path:      c.Path,
+		audience:  c.Audience,
+		schema:    c.Schema,
+		tokens:    tokens,
+		tlsConfig: tlsconfig.MTLSClientConfig(x509Source, bundleSource, c.server.authorizer(c.Name)),
+		timeout:   c.timeout,
+	}
+	u.client = u.newClient()
+
+	return u
+}
+
+// newClient creates a client with its own connection pool
+func (u *upstream) newClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: u.dialTLS,
+		},
+		Timeout: u.timeout,
+	}
+}
+
+// currentClient returns the client of the current X509-SVID
+func (u *upstream) currentClient() *http.Client {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.client
+}
+
+// table is an upstream response rendered in the page
+type table struct {
+	Name    string
+	Columns []string
+	Rows    [][]string
+	Err     error
+	// Unauthorized is set when Err is caused by the server identity
+	Unauthorized bool
+	// Rejected is set when Err is an error response of the upstream
+	Rejected *requestError
+}
+
+// fetchTable requests the upstream items and extracts the schema columns
+func (u *upstream) fetchTable(ctx context.Context) *table {
+	t := &table{
+		Name:    u.name,
+		Columns: u.schema.Columns,
+	}
+
+	var resp map[string]interface{}
+	if err := u.get(ctx, u.path, &resp); err != nil {
+		var authzErr *serverAuthorizationError
+		t.Unauthorized = errors.As(err, &authzErr)
+		errors.As(err, &t.Rejected)
+		t.Err = err
+		return t
+	}
+
+	// Empty lists may be encoded as null
+	if resp[u.schema.Items] == nil {
+		return t
+	}
+	items, ok := resp[u.schema.Items].([]interface{})
+	if !ok {
+		t.Err = fmt.Errorf("response field %q is not a list", u.schema.Items)
+		return t
+	}
+
+	for _, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			t.Err = fmt.Errorf("response field %q contains a non object item", u.schema.Items)
+			return t
+		}
+
+		row := make([]string, 0, len(t.Columns))
+		for _, column := range t.Columns {
+			value := ""
+			if fields[column] != nil {
+				value = fmt.Sprint(fields[column])
+			}
+			row = append(row, value)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+
+	return t
+}
+
+// get sends a GET request to path and decodes the JSON response into out
+func (u *upstream) get(ctx context.Context, path string, out interface{}) error {
+	svid, err := u.tokens.fetch(ctx, u.audience)
+	if err != nil {
+		return err
+	}
+
+	var serial string
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn, ok := info.Conn.(*certConn); ok {
+				serial = conn.serial
+			}
+			reused = info.Reused
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, u.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", svid.Marshal()))
+
+	client := u.currentClient()
+	// Runs once the connection is released by the response body
+	defer u.release(client)
+	resp, err := client.Do(req)
+	if err != nil {
+		var authzErr *serverAuthorizationError
+		if errors.As(err, &authzErr) {
+			log.Error("Upstream server identity rejected", "upstream", u.name, "server_id", authzErr.ServerID,
+				"reason", authzErr.Reason)
+			return authzErr
+		}
+		return fmt.Errorf("error connecting to %q: %w", u.baseURL, err)
+	}
+	defer resp.Body.Close()
+
+	log.Info("Upstream request", "upstream", u.name, "path", path, "status", resp.StatusCode,
+		"client_cert_serial", serial, "reused_connection", reused)
+
+	if resp.StatusCode != http.StatusOK {
+		reqErr := newRequestError(resp)
+		log.Error("Upstream rejected the request", "upstream", u.name, "path", path, "status", reqErr.Status,
+			"code", reqErr.Code, "message", reqErr.Message)
+		return reqErr
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// maxErrorBodySize limits how much of an error response is read
+const maxErrorBodySize = 16 << 10
+
+// requestError is a request rejected by the upstream. Code, Message and
+// Details are taken from the JSON error envelope, services that do not
+// return one only provide the response text as Message.
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+	Details []requestErrorDetail
+}
+
+// requestErrorDetail describes an invalid request field
+type requestErrorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func newRequestError(resp *http.Response) *requestError {
+	reqErr := &requestError{Status: resp.StatusCode}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return reqErr
+	}
+
+	var envelope struct {
+		Error struct {
+			Code    string               `json:"code"`
+			Message string               `json:"message"`
+			Details []requestErrorDetail `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error.Code != "" {
+		reqErr.Code = envelope.Error.Code
+		reqErr.Message = envelope.Error.Message
+		reqErr.Details = envelope.Error.Details
+		return reqErr
+	}
+	reqErr.Message = strings.TrimSpace(string(body))
+	return reqErr
+}
+
+// StatusText describes the status code, e.g. "403 Forbidden"
+func (e *requestError) StatusText() string {
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+func (e *requestError) Error() string {
+	msg := "request rejected with " + e.StatusText()
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	for _, detail := range e.Details {
+		msg += fmt.Sprintf(", %s %s", detail.Field, detail.Message)
+	}
+	return msg
+}
+
+// rotate replaces the client, so no following request uses a connection
+// opened with a previous X509-SVID. Connections of the previous client that
+// are in use are closed by release when their request finishes.
+func (u *upstream) rotate() {
+	u.mu.Lock()
+	old := u.client
+	u.client = u.newClient()
+	u.mu.Unlock()
+
+	old.CloseIdleConnections()
+	log.Info("Upstream client replaced", "upstream", u.name)
+}
+
+// release closes the idle connections of client if it was replaced while a
+// request was using it
+func (u *upstream) release(client *http.Client) {
+	if client != u.currentClient() {
+		client.CloseIdleConnections()
+	}
+}
+
+// dialTLS opens a TLS connection and keeps the serial of the client
+// certificate presented during the handshake
+func (u *upstream) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	var serial string
+	config := u.tlsConfig.Clone()
+	getClientCertificate := config.GetClientCertificate
+	config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := getClientCertificate(info)
+		if err == nil && len(cert.Certificate) > 0 {
+			if leaf, parseErr := x509.ParseCertificate(cert.Certificate[0]); parseErr == nil {
+				serial = leaf.SerialNumber.Text(16)
+			}
+		}
+		return cert, err
+	}
+
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certConn{Conn: conn, serial: serial}, nil
+}
+
+// certConn is a TLS connection together with the client certificate serial
+type certConn struct {
+	net.Conn
+	serial string
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClientCertificates switches the certificate presented by clients
+type testClientCertificates struct {
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func (c *testClientCertificates) set(t *testing.T, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (c *testClientCertificates) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// TestUpstreamRotate verifies no request is sent with a previous X509-SVID
+// after a rotation, including over connections that were in use when it
+// happened
+func TestUpstreamRotate(t *testing.T) {
+	started, slow := make(chan struct{}), make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-slow
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"serial": "` + r.TLS.PeerCertificates[0].SerialNumber.Text(16) + `"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	var mu sync.Mutex
+	open := make(map[net.Conn]bool)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		if state == http.StateClosed || state == http.StateHijacked {
+			delete(open, conn)
+		} else {
+			open[conn] = true
+		}
+	}
+	openConns := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(open)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	certs := &testClientCertificates{}
+	certs.set(t, 1)
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.GetClientCertificate = certs.get
+
+	u := &upstream{
+		name:      "test",
+		baseURL:   server.URL,
+		audience:  "test",
+		tokens:    newTestTokenCache(newFakeJWTSource(time.Hour), 0.5),
+		tlsConfig: tlsConfig,
+		timeout:   5 * time.Second,
+	}
+	u.client = u.newClient()
+
+	serial := func(path string) string {
+		t.Helper()
+		var resp struct{ Serial string }
+		if err := u.get(context.Background(), path, &resp); err != nil {
+			t.Error(err)
+		}
+		return resp.Serial
+	}
+
+	if got := serial("/"); got != "1" {
+		t.Fatalf("serial = %q, want 1", got)
+	}
+
+	// The idle connection is reused by a request that is in flight while
+	// the X509-SVID rotates
+	done := make(chan string)
+	go func() { done <- serial("/slow") }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not reach the server")
+	}
+	certs.set(t, 2)
+	u.rotate()
+	// A request sent while the connection is still in use
+	if got := serial("/"); got != "2" {
+		t.Fatalf("serial after rotation = %q, want 2", got)
+	}
+	close(slow)
+	if got := <-done; got != "1" {
+		t.Fatalf("in-flight request serial = %q, want 1", got)
+	}
+
+	for range 3 {
+		if got := serial("/"); got != "2" {
+			t.Fatalf("serial after rotation = %q, want 2", got)
+		}
+	}
+
+	// The connection of the in-flight request is closed once released
+	deadline := time.Now().Add(5 * time.Second)
+	for openConns() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d open connections, want 1", openConns())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"rotation/service"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+type authenticator struct {
+	// Bundles used to verify tokens, by issuing trust domain
+	bundles jwtbundle.Source
+	// Expected audiences
+	audiences []string
+	// Counts token validations by result
+	validations *prometheus.CounterVec
+	log         *slog.Logger
+}
+
+func (a *authenticator) authenticateClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fields := strings.Fields(req.Header.Get("Authorization"))
+		if len(fields) != 2 || fields[0] != "Bearer" {
+			a.log.Error("Malformed header")
+			a.validations.WithLabelValues("failure").Inc()
+			service.WriteError(w, http.StatusUnauthorized, service.CodeUnauthenticated, "missing or unsupported authorization header, a bearer JWT-SVID is required")
+			return
+		}
+
+		// Tokens are validated against the bundle of their trust domain,
+		// fetched from the Workload API
+		svid, err := jwtsvid.ParseAndValidate(fields[1], a.bundles, a.audiences)
+		if err != nil {
+			a.log.Error("Invalid token", "error", err)
+			a.validations.WithLabelValues("failure").Inc()
+			service.WriteError(w, http.StatusUnauthorized, service.CodeUnauthenticated, "JWT-SVID is not valid")
+			return
+		}
+
+		a.log.Debug("Token validated", "sub", svid.ID.String(), "trust_domain", svid.ID.TrustDomain())
+		a.validations.WithLabelValues("success").Inc()
+		req = req.WithContext(service.WithSVIDClaims(req.Context(), svid.Claims))
+		next.ServeHTTP(w, req)
+	})
+}
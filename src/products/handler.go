@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"rotation/service"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxBodySize is the largest request body accepted, in bytes
+	maxBodySize = 4 << 10
+	// maxNameLength is the longest product name accepted, in characters
+	maxNameLength = 40
+)
+
+type ListResponse struct {
+	Products []*Product `json:"products"`
+}
+
+// productRequest is the body of insert requests, fields are nil when they
+// are not present
+type productRequest struct {
+	Name  *string `json:"name"`
+	Stock *int    `json:"stock"`
+}
+
+type Handler struct {
+	store *store
+	log   *slog.Logger
+}
+
+func NewHandler(store *store, log *slog.Logger) *Handler {
+	return &Handler{
+		store: store,
+		log:   log,
+	}
+}
+
+func (h *Handler) ProductsList(w http.ResponseWriter, r *http.Request) {
+	h.log.Info("List products called...")
+	h.writeJSON(w, http.StatusOK, &ListResponse{Products: h.store.list()})
+}
+
+func (h *Handler) ProductInsert(w http.ResponseWriter, r *http.Request) {
+	h.log.Info("Insert product called...")
+	defer r.Body.Close()
+
+	req := &productRequest{}
+	reqErr := service.DecodeJSON(w, r, req, maxBodySize)
+	if reqErr == nil {
+		reqErr = req.validate()
+	}
+	if reqErr != nil {
+		h.log.Error("Invalid request", "error", reqErr, "details", reqErr.Details)
+		reqErr.Write(w)
+		return
+	}
+
+	product := Product{Name: *req.Name}
+	if req.Stock != nil {
+		product.Stock = *req.Stock
+	}
+	if err := h.store.insert(product); err != nil {
+		if errors.Is(err, errProductExists) {
+			service.WriteError(w, http.StatusConflict, service.CodeConflict, fmt.Sprintf("product %q already exists", product.Name))
+			return
+		}
+		h.log.Error("Failed to insert product", "error", err)
+		service.WriteError(w, http.StatusInternalServerError, service.CodeInternal, "internal error, try again later")
+		return
+	}
+	h.writeJSON(w, http.StatusCreated, &product)
+}
+
+// validate trims the product name and verifies the fields, the stock
+// defaults to 0
+func (p *productRequest) validate() *service.RequestError {
+	var details []service.FieldError
+	switch {
+	case p.Name == nil:
+		details = append(details, service.FieldError{Field: "name", Message: "is required"})
+	case strings.TrimSpace(*p.Name) == "":
+		details = append(details, service.FieldError{Field: "name", Message: "must not be empty"})
+	case utf8.RuneCountInString(strings.TrimSpace(*p.Name)) > maxNameLength:
+		details = append(details, service.FieldError{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxNameLength)})
+	default:
+		*p.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.Stock != nil && *p.Stock < 0 {
+		details = append(details, service.FieldError{Field: "stock", Message: "must not be negative"})
+	}
+
+	if len(details) > 0 {
+		return service.InvalidFields(details...)
+	}
+	return nil
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Error("Error processing payload", "error", err)
+	}
+}
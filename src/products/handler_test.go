@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"rotation/service"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *store {
+	s, err := newStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantAllow  string
+		wantBody   string
+	}{
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			target:     "/products",
+			wantStatus: http.StatusOK,
+			wantBody: `{"products":[{"name":"Keyboard","stock":12},{"name":"Mouse","stock":30},` +
+				`{"name":"Monitor","stock":5},{"name":"Headset","stock":8}]}`,
+		},
+		{
+			name:       "insert",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":" Webcam ","stock":3}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"name":"Webcam","stock":3}`,
+		},
+		{
+			name:       "insert without stock",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"Webcam"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"name":"Webcam","stock":0}`,
+		},
+		{
+			name:       "insert existing product",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"Mouse","stock":1}`,
+			wantStatus: http.StatusConflict,
+			wantBody:   `{"error":{"code":"conflict","message":"product \"Mouse\" already exists"}}`,
+		},
+		{
+			name:       "insert invalid fields",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"","stock":-1}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"must not be empty"},{"field":"stock","message":"must not be negative"}]}}`,
+		},
+		{
+			name:       "insert missing name",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"stock":1}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"is required"}]}}`,
+		},
+		{
+			name:       "insert name too long",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"` + strings.Repeat("a", maxNameLength+1) + `"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"name","message":"must be at most 40 characters"}]}}`,
+		},
+		{
+			name:       "insert unknown field",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"Webcam","price":10}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"price","message":"is not a known field"}]}}`,
+		},
+		{
+			name:       "insert wrong type",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"Webcam","stock":"3"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: `{"error":{"code":"validation_failed","message":"request has invalid fields",` +
+				`"details":[{"field":"stock","message":"must be a number"}]}}`,
+		},
+		{
+			name:       "insert invalid body",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"invalid_request","message":"request body is not valid JSON"}}`,
+		},
+		{
+			name:       "insert body too large",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			body:       `{"name":"` + strings.Repeat("a", maxBodySize) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   `{"error":{"code":"body_too_large","message":"request body must not be larger than 4096 bytes"}}`,
+		},
+		{
+			name:       "list method not allowed",
+			method:     http.MethodPost,
+			target:     "/products",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET",
+			wantBody:   `{"error":{"code":"method_not_allowed","message":"method POST is not allowed on /products"}}`,
+		},
+		{
+			name:       "insert method not allowed",
+			method:     http.MethodGet,
+			target:     "/product/insert",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "POST",
+		},
+		{
+			name:       "unknown route",
+			method:     http.MethodGet,
+			target:     "/customers",
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":{"code":"not_found","message":"route /customers not found"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newRouter(NewHandler(newTestStore(t), slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if allow := rec.Header().Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+			if tt.wantBody != "" {
+				if body := strings.TrimSpace(rec.Body.String()); body != tt.wantBody {
+					t.Errorf("body = %s, want %s", body, tt.wantBody)
+				}
+			}
+		})
+	}
+}
+
+// TestProductsHandler verifies authentication runs first and policies only
+// apply to existing routes and methods
+func TestProductsHandler(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	authz, err := service.NewAuthorizer([]service.PolicyConfig{
+		{
+			Route:      "/products",
+			Methods:    []string{"GET"},
+			AllowedIDs: []string{"spiffe://cluster.demo/ns/client-ns/sa/default"},
+		},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for the authenticator, the caller is the "sub" header
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			claims := map[string]interface{}{"sub": req.Header.Get("sub")}
+			next.ServeHTTP(w, req.WithContext(service.WithSVIDClaims(req.Context(), claims)))
+		})
+	}
+	handler := authenticate(newRouter(NewHandler(newTestStore(t), log), authz.Middleware(nil)))
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		sub        string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "allowed",
+			method:     http.MethodGet,
+			target:     "/products",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/default",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "caller not allowed",
+			method:     http.MethodGet,
+			target:     "/products",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusForbidden,
+			wantCode:   service.CodeForbidden,
+		},
+		{
+			name:       "route without policy",
+			method:     http.MethodPost,
+			target:     "/product/insert",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/default",
+			wantStatus: http.StatusForbidden,
+			wantCode:   service.CodeForbidden,
+		},
+		{
+			name:       "method not allowed before policies",
+			method:     http.MethodDelete,
+			target:     "/products",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   service.CodeMethodNotAllowed,
+		},
+		{
+			name:       "unknown route before policies",
+			method:     http.MethodGet,
+			target:     "/customers",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusNotFound,
+			wantCode:   service.CodeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.Header.Set("sub", tt.sub)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var resp service.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if resp.Error.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", resp.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorRejectsMissingToken(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	authz, err := service.NewAuthorizer(nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &authenticator{
+		audiences:   []string{"aud"},
+		validations: service.NewValidationsCounter(),
+		log:         log,
+	}
+	handler := newProductsHandler(NewHandler(newTestStore(t), log), auth, authz)
+
+	for _, header := range []string{"", "Basic dXNlcjpwYXNz", "Bearer not-a-token"} {
+		req := httptest.NewRequest(http.MethodGet, "/products", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		var resp service.ErrorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("%q: failed to decode error response: %v", header, err)
+		}
+		if rec.Code != http.StatusUnauthorized || resp.Error.Code != service.CodeUnauthenticated {
+			t.Errorf("%q: status = %d, code = %q, want 401 and %q", header, rec.Code, resp.Error.Code, service.CodeUnauthenticated)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"rotation"
+	"rotation/service"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/spiffe/go-spiffe/v2/logger"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	configFilePath = flag.String("config", "products.hcl", "Path to configuration file")
+	log            = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+)
+
+type config struct {
+	Host      string `hcl:"host"`
+	Port      int    `hcl:"port"`
+	AgentSock string `hcl:"agent_sock"`
+	// Trust domain of the service, "cluster.demo" when not set
+	TrustDomain string `hcl:"trust_domain,optional"`
+	// Trust domains federated with TrustDomain, their workloads are allowed
+	// to connect and present JWT-SVIDs
+	FederatedTrustDomains []string `hcl:"federated_trust_domains,optional"`
+	// Audiences accepted in JWT-SVIDs, the first one is used when this
+	// service fetches its own JWT-SVID. Defaults to "aud".
+	Audiences []string `hcl:"audiences,optional"`
+	// Plain HTTP port for status endpoints, disabled when 0
+	AdminPort int `hcl:"admin_port,optional"`
+	// Authority key IDs that are expected to be revoked
+	TaintedAuthorities []string `hcl:"tainted_authorities,optional"`
+	// Routes access by caller SPIFFE ID
+	Policies []service.PolicyConfig `hcl:"policy,block"`
+}
+
+func start() error {
+	flag.Parse()
+
+	log.Info("Reading configuration file", "path", *configFilePath)
+	var c config
+	if err := hclsimple.DecodeFile(*configFilePath, nil, &c); err != nil {
+		return fmt.Errorf("error parsing configuration file: %w", err)
+	}
+
+	identity, err := service.ParseIdentity(c.TrustDomain, c.FederatedTrustDomains, c.Audiences)
+	if err != nil {
+		return fmt.Errorf("invalid identity configuration: %w", err)
+	}
+	td, trusted := identity.TrustDomain, identity.Trusted
+	log.Info("Trusted trust domains", "trust_domain", td, "federated", c.FederatedTrustDomains)
+
+	authz, err := service.NewAuthorizer(c.Policies, log)
+	if err != nil {
+		return fmt.Errorf("invalid policy configuration: %w", err)
+	}
+
+	s, err := newStore()
+	if err != nil {
+		return fmt.Errorf("unable to create store: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientOptions := workloadapi.WithClientOptions(workloadapi.WithAddr(c.AgentSock), workloadapi.WithLogger(logger.Std))
+
+	log.Info("Creating X509Source")
+	source, err := workloadapi.NewX509Source(ctx, clientOptions)
+	if err != nil {
+		return fmt.Errorf("unable to create X509Source: %w", err)
+	}
+	defer source.Close()
+
+	bundleSource, err := workloadapi.NewBundleSource(ctx, clientOptions)
+	if err != nil {
+		return fmt.Errorf("unable to create BundleSource %w", err)
+	}
+	defer bundleSource.Close()
+
+	tracker := rotation.NewTracker(log)
+	taint := rotation.NewTaintDetector(c.TaintedAuthorities, log)
+	metrics := rotation.NewMetrics()
+	// The TLS server gets the SVID from the source on every handshake, so
+	// updates are only observed
+	u := &service.X509Updater{
+		Source:  source,
+		Tracker: tracker,
+		Taint:   taint,
+		Metrics: metrics,
+		Log:     log,
+	}
+	if err := u.HandleUpdate(); err != nil {
+		return fmt.Errorf("failed to handle initial SVID: %w", err)
+	}
+
+	go u.Monitor(ctx)
+
+	jwtSource, err := workloadapi.NewJWTSource(ctx, clientOptions)
+	if err != nil {
+		return fmt.Errorf("unable to create JWTSource: %w", err)
+	}
+	defer jwtSource.Close()
+
+	jwtUpdater := &service.JWTUpdater{
+		Source:      jwtSource,
+		TrustDomain: td,
+		Audience:    identity.Audiences[0],
+		Tracker:     tracker,
+		Taint:       taint,
+		Metrics:     metrics,
+		Log:         log,
+	}
+	go jwtUpdater.Monitor(ctx)
+	go service.MonitorBundleUpdates(ctx, bundleSource, trusted, tracker, metrics, taint)
+
+	auth := &authenticator{
+		bundles:     &service.TrustedBundles{Source: bundleSource, TrustDomains: trusted},
+		audiences:   identity.Audiences,
+		validations: service.NewValidationsCounter(),
+		log:         log,
+	}
+	metrics.MustRegister(auth.validations)
+
+	if c.AdminPort != 0 {
+		go service.ServeAdmin(c.AdminPort, service.NewAdminHandler(taint, metrics, tracker), log)
+	}
+
+	// Peers from federated trust domains are verified with their own bundle
+	tlsConfig := tlsconfig.MTLSServerConfig(source, bundleSource, tlsconfig.AdaptMatcher(rotation.MatchMemberOfAny(trusted)))
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(c.Port),
+		Handler:           newProductsHandler(NewHandler(s, log), auth, authz),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	log.Info("Service starting", "host", c.Host, "port", c.Port)
+	return server.ListenAndServeTLS("", "")
+}
+
+func main() {
+	if err := start(); err != nil {
+		log.Error("Service failed to start", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"rotation/service"
+	"slices"
+	"strings"
+)
+
+// newProductsHandler authenticates every request, policies are applied to
+// the matched route
+func newProductsHandler(h *Handler, auth *authenticator, authz *service.Authorizer) http.Handler {
+	return auth.authenticateClient(newRouter(h, authz.Middleware(nil)))
+}
+
+// newRouter registers the product routes, middlewares run only for requests
+// matching a route and method. Routes have no path variables, so the request
+// path is the route matched by policies.
+func newRouter(h *Handler, middlewares ...func(http.Handler) http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(route string, handler http.HandlerFunc, methods ...string) {
+		var next http.Handler = handler
+		for _, middleware := range slices.Backward(middlewares) {
+			next = middleware(next)
+		}
+		mux.Handle(route, allowMethods(next, methods...))
+	}
+
+	handle("/products", h.ProductsList, http.MethodGet)
+	handle("/product/insert", h.ProductInsert, http.MethodPost)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		service.WriteError(w, http.StatusNotFound, service.CodeNotFound, fmt.Sprintf("route %s not found", req.URL.Path))
+	})
+
+	return mux
+}
+
+// allowMethods responds with the allowed methods in the Allow header to
+// requests using other methods
+func allowMethods(next http.Handler, methods ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !slices.Contains(methods, req.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			service.WriteError(w, http.StatusMethodNotAllowed, service.CodeMethodNotAllowed,
+				fmt.Sprintf("method %s is not allowed on %s", req.Method, req.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// seed holds the products loaded when the service starts
+//
+//go:embed products.json
+var seed []byte
+
+var errProductExists = errors.New("product already exists")
+
+type Product struct {
+	Name  string `json:"name"`
+	Stock int    `json:"stock"`
+}
+
+// store keeps products in memory, changes are lost when the service restarts
+type store struct {
+	mu       sync.RWMutex
+	products []*Product
+}
+
+func newStore() (*store, error) {
+	s := new(store)
+	if err := json.Unmarshal(seed, &s.products); err != nil {
+		return nil, fmt.Errorf("failed to load seed products: %w", err)
+	}
+	return s, nil
+}
+
+func (s *store) list() []*Product {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := make([]*Product, 0, len(s.products))
+	for _, p := range s.products {
+		product := *p
+		products = append(products, &product)
+	}
+	return products
+}
+
+// insert adds p, validated by the caller, product names are unique
+func (s *store) insert(p Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.ContainsFunc(s.products, func(existing *Product) bool { return existing.Name == p.Name }) {
+		return fmt.Errorf("%w: %q", errProductExists, p.Name)
+	}
+	s.products = append(s.products, &p)
+	return nil
+}
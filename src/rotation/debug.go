@@ -0,0 +1,213 @@
+package rotation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// updateHistorySize is the number of updates kept by the Tracker
+	updateHistorySize = 20
+	// eventHistorySize is the number of events kept by the Tracker
+	eventHistorySize = 100
+	// subscriberBufferSize is the number of events queued per subscriber
+	subscriberBufferSize = 32
+)
+
+// Update is a notification received from a Workload API source
+type Update struct {
+	// Source of the update, e.g. "x509", "jwt" or "bundle"
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+// X509SVIDInfo describes the current X509-SVID
+type X509SVIDInfo struct {
+	SPIFFEID       string    `json:"spiffe_id"`
+	Serial         string    `json:"serial"`
+	SubjectKeyID   string    `json:"subject_key_id"`
+	AuthorityKeyID string    `json:"authority_key_id"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	// Chain holds the leaf certificate followed by intermediates
+	Chain []CertificateInfo `json:"chain"`
+}
+
+// CertificateInfo is a certificate of an X509-SVID chain
+type CertificateInfo struct {
+	Subject        string    `json:"subject"`
+	SubjectKeyID   string    `json:"subject_key_id"`
+	AuthorityKeyID string    `json:"authority_key_id"`
+	NotAfter       time.Time `json:"not_after"`
+}
+
+// JWTSVIDInfo describes the last fetched JWT-SVID, the token is not included
+type JWTSVIDInfo struct {
+	SPIFFEID string    `json:"spiffe_id"`
+	KeyID    string    `json:"key_id"`
+	Audience []string  `json:"audience"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// X509AuthorityInfo is an X.509 authority of a bundle
+type X509AuthorityInfo struct {
+	KeyID     string    `json:"key_id"`
+	Subject   string    `json:"subject"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// JWTAuthorityInfo is a JWT authority of a bundle
+type JWTAuthorityInfo struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// BundleInfo holds the authorities of a trust domain
+type BundleInfo struct {
+	TrustDomain     string              `json:"trust_domain"`
+	X509Authorities []X509AuthorityInfo `json:"x509_authorities"`
+	JWTAuthorities  []JWTAuthorityInfo  `json:"jwt_authorities"`
+}
+
+// Snapshot is the state last observed by the Tracker
+type Snapshot struct {
+	X509SVID *X509SVIDInfo `json:"x509_svid,omitempty"`
+	JWTSVID  *JWTSVIDInfo  `json:"jwt_svid,omitempty"`
+	Bundles  []BundleInfo  `json:"bundles"`
+	// Updates are the last received updates, newest first
+	Updates []Update `json:"updates"`
+	// Events are the last rotation events, oldest first
+	Events []Event `json:"events"`
+}
+
+// RecordUpdate adds an update received from source to the history
+func (t *Tracker) RecordUpdate(source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.updates = append(t.updates, Update{Source: source, Time: time.Now()})
+	if len(t.updates) > updateHistorySize {
+		t.updates = slices.Clone(t.updates[len(t.updates)-updateHistorySize:])
+	}
+}
+
+// Snapshot returns the last observed SVIDs, bundles and updates
+func (t *Tracker) Snapshot() Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := Snapshot{
+		Bundles: []BundleInfo{},
+		Updates: slices.Clone(t.updates),
+		Events:  slices.Clone(t.events),
+	}
+	slices.Reverse(s.Updates)
+
+	if t.x509SVID != nil {
+		leaf := t.x509SVID.Certificates[0]
+		s.X509SVID = &X509SVIDInfo{
+			SPIFFEID:       t.x509SVID.ID.String(),
+			Serial:         leaf.SerialNumber.Text(16),
+			SubjectKeyID:   KeyID(leaf.SubjectKeyId),
+			AuthorityKeyID: KeyID(leaf.AuthorityKeyId),
+			NotBefore:      leaf.NotBefore,
+			NotAfter:       leaf.NotAfter,
+		}
+		for _, cert := range t.x509SVID.Certificates {
+			s.X509SVID.Chain = append(s.X509SVID.Chain, CertificateInfo{
+				Subject:        cert.Subject.String(),
+				SubjectKeyID:   KeyID(cert.SubjectKeyId),
+				AuthorityKeyID: KeyID(cert.AuthorityKeyId),
+				NotAfter:       cert.NotAfter,
+			})
+		}
+	}
+	if t.jwtSVID != nil {
+		s.JWTSVID = &JWTSVIDInfo{
+			SPIFFEID: t.jwtSVID.ID.String(),
+			KeyID:    t.jwtSVIDKey,
+			Audience: t.jwtSVID.Audience,
+			Expiry:   t.jwtSVID.Expiry,
+		}
+	}
+
+	bundles := make(map[string]*BundleInfo)
+	bundleInfo := func(td string) *BundleInfo {
+		if bundles[td] == nil {
+			bundles[td] = &BundleInfo{
+				TrustDomain:     td,
+				X509Authorities: []X509AuthorityInfo{},
+				JWTAuthorities:  []JWTAuthorityInfo{},
+			}
+		}
+		return bundles[td]
+	}
+	for td, bundle := range t.x509Bundles {
+		info := bundleInfo(td.String())
+		for _, authority := range bundle.X509Authorities() {
+			info.X509Authorities = append(info.X509Authorities, X509AuthorityInfo{
+				KeyID:     KeyID(authority.SubjectKeyId),
+				Subject:   authority.Subject.String(),
+				NotBefore: authority.NotBefore,
+				NotAfter:  authority.NotAfter,
+			})
+		}
+		slices.SortFunc(info.X509Authorities, func(a, b X509AuthorityInfo) int {
+			return a.NotBefore.Compare(b.NotBefore)
+		})
+	}
+	for td, bundle := range t.jwtBundles {
+		info := bundleInfo(td.String())
+		for _, keyID := range jwtAuthorityKeyIDs(bundle) {
+			authority, _ := bundle.FindJWTAuthority(keyID)
+			info.JWTAuthorities = append(info.JWTAuthorities, JWTAuthorityInfo{
+				KeyID:     keyID,
+				Algorithm: keyAlgorithm(authority),
+			})
+		}
+	}
+
+	for _, info := range bundles {
+		s.Bundles = append(s.Bundles, *info)
+	}
+	slices.SortFunc(s.Bundles, func(a, b BundleInfo) int {
+		return strings.Compare(a.TrustDomain, b.TrustDomain)
+	})
+
+	return s
+}
+
+// ServeHTTP returns the current snapshot as JSON
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Snapshot()); err != nil {
+		t.log.Error("Failed to encode rotation snapshot", "error", err)
+	}
+}
+
+// keyAlgorithm describes the type and size of a public key, e.g. "EC P-256"
+func keyAlgorithm(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return "EC " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package rotation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func getSnapshot(t *testing.T, tracker *Tracker) (Snapshot, map[string]json.RawMessage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	tracker.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/rotation", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("content type = %q, want application/json", contentType)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	var s Snapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s, fields
+}
+
+func TestTrackerServeHTTP(t *testing.T) {
+	tracker := NewTracker(testLogger())
+
+	s, fields := getSnapshot(t, tracker)
+	for _, field := range []string{"x509_svid", "jwt_svid"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("%s is set before any observation", field)
+		}
+	}
+	if string(fields["bundles"]) != "[]" {
+		t.Errorf("bundles = %s, want []", fields["bundles"])
+	}
+	if len(s.Updates) != 0 || len(s.Events) != 0 {
+		t.Errorf("updates = %+v, events = %+v, want none", s.Updates, s.Events)
+	}
+
+	tracker.RecordUpdate("bundle")
+	tracker.RecordUpdate("x509")
+	tracker.ObserveX509(testX509SVID(0xb2, 0x02), testX509Bundle(0xb2, 0xa1))
+	tracker.ObserveJWTBundle(testJWTBundle(t, "k1"))
+	tracker.ObserveJWTSVID(testJWTSVID(t, "k1"))
+
+	s, _ = getSnapshot(t, tracker)
+	if s.X509SVID == nil || s.X509SVID.SPIFFEID != testID.String() || s.X509SVID.SubjectKeyID != "02" ||
+		s.X509SVID.AuthorityKeyID != "b2" || s.X509SVID.Serial != "2" || len(s.X509SVID.Chain) != 1 {
+		t.Errorf("X509-SVID = %+v, want serial 2 signed by b2", s.X509SVID)
+	}
+	if s.JWTSVID == nil || s.JWTSVID.KeyID != "k1" || !slices.Equal(s.JWTSVID.Audience, []string{"aud"}) {
+		t.Errorf("JWT-SVID = %+v, want signed by k1", s.JWTSVID)
+	}
+
+	if len(s.Bundles) != 1 || s.Bundles[0].TrustDomain != testTD.String() {
+		t.Fatalf("bundles = %+v, want %s", s.Bundles, testTD)
+	}
+	var x509Authorities []string
+	for _, authority := range s.Bundles[0].X509Authorities {
+		x509Authorities = append(x509Authorities, authority.KeyID)
+	}
+	// Authorities are sorted by activation
+	if !slices.Equal(x509Authorities, []string{"a1", "b2"}) {
+		t.Errorf("X.509 authorities = %v, want [a1 b2]", x509Authorities)
+	}
+	if jwtAuthorities := s.Bundles[0].JWTAuthorities; len(jwtAuthorities) != 1 ||
+		jwtAuthorities[0].KeyID != "k1" || jwtAuthorities[0].Algorithm != "EC P-256" {
+		t.Errorf("JWT authorities = %+v, want k1 EC P-256", jwtAuthorities)
+	}
+
+	// Updates are returned newest first
+	var updates []string
+	for _, update := range s.Updates {
+		updates = append(updates, update.Source)
+	}
+	if !slices.Equal(updates, []string{"x509", "bundle"}) {
+		t.Errorf("updates = %v, want [x509 bundle]", updates)
+	}
+	if len(s.Events) != 6 {
+		t.Errorf("events = %+v, want 6", s.Events)
+	}
+}
+
+func TestTrackerServeHTTPMethod(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewTracker(testLogger()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/rotation", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
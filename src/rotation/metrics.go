@@ -0,0 +1,100 @@
+package rotation
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Metrics exports SVID and bundle lifecycle metrics in Prometheus format
+type Metrics struct {
+	registry *prometheus.Registry
+
+	svidExpiry      *prometheus.GaugeVec
+	svidInfo        *prometheus.GaugeVec
+	x509Authorities *prometheus.GaugeVec
+	jwtAuthorities  *prometheus.GaugeVec
+	updates         *prometheus.CounterVec
+}
+
+// NewMetrics creates a new registry with SVID and bundle metrics, together
+// with the default Go and process collectors
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		svidExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "svid_expiry_timestamp_seconds",
+			Help: "Expiration time of the current X509-SVID, in unix seconds.",
+		}, []string{"spiffe_id"}),
+		svidInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "svid_info",
+			Help: "Current X509-SVID, always 1.",
+		}, []string{"spiffe_id", "serial", "authority_key_id"}),
+		x509Authorities: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bundle_x509_authorities",
+			Help: "Number of X.509 authorities in the bundle.",
+		}, []string{"trust_domain"}),
+		jwtAuthorities: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bundle_jwt_authorities",
+			Help: "Number of JWT authorities in the bundle.",
+		}, []string{"trust_domain"}),
+		updates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workloadapi_updates_total",
+			Help: "Number of updates received from the Workload API sources.",
+		}, []string{"source"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.svidExpiry,
+		m.svidInfo,
+		m.x509Authorities,
+		m.jwtAuthorities,
+		m.updates,
+	)
+
+	return m
+}
+
+// MustRegister adds service specific collectors to the registry
+func (m *Metrics) MustRegister(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// Handler serves the registry in Prometheus format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveX509 updates SVID and X.509 bundle metrics
+func (m *Metrics) ObserveX509(svid *x509svid.SVID, bundle *x509bundle.Bundle) {
+	leaf := svid.Certificates[0]
+
+	// Only the current SVID is reported
+	m.svidInfo.Reset()
+	m.svidInfo.WithLabelValues(svid.ID.String(), leaf.SerialNumber.Text(16), KeyID(leaf.AuthorityKeyId)).Set(1)
+	m.svidExpiry.WithLabelValues(svid.ID.String()).Set(float64(leaf.NotAfter.Unix()))
+	m.x509Authorities.WithLabelValues(bundle.TrustDomain().String()).Set(float64(len(bundle.X509Authorities())))
+}
+
+// ObserveX509Bundle updates X.509 bundle metrics of a trust domain the
+// workload has no SVID for, e.g. a federated one
+func (m *Metrics) ObserveX509Bundle(bundle *x509bundle.Bundle) {
+	m.x509Authorities.WithLabelValues(bundle.TrustDomain().String()).Set(float64(len(bundle.X509Authorities())))
+}
+
+// ObserveJWTBundle updates JWT bundle metrics
+func (m *Metrics) ObserveJWTBundle(bundle *jwtbundle.Bundle) {
+	m.jwtAuthorities.WithLabelValues(bundle.TrustDomain().String()).Set(float64(len(bundle.JWTAuthorities())))
+}
+
+// IncUpdates counts an Updated() event for source, e.g. "x509" or "jwt"
+func (m *Metrics) IncUpdates(source string) {
+	m.updates.WithLabelValues(source).Inc()
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"rotation"
+	"strconv"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// NewAdminHandler serves the rotation status, metrics and debug endpoints
+func NewAdminHandler(taint *rotation.TaintDetector, metrics *rotation.Metrics, tracker *rotation.Tracker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/status/authority", taint)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/debug/rotation", tracker)
+	return mux
+}
+
+// ServeAdmin serves handler over plain HTTP on port, it only returns when
+// the server fails
+func ServeAdmin(port int, handler http.Handler, log *slog.Logger) {
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           handler,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	log.Info("Admin server starting", "port", port)
+	if err := server.ListenAndServe(); err != nil {
+		log.Error("Admin server failed", "error", err)
+	}
+}
+
+// UpdatedBundleSource is a bundle source that notifies updates, it is
+// implemented by workloadapi.BundleSource
+type UpdatedBundleSource interface {
+	rotation.BundleSource
+	Updated() <-chan struct{}
+}
+
+// MonitorBundleUpdates reports the authorities of every trusted trust
+// domain each time a bundle changes, until ctx is done
+func MonitorBundleUpdates(ctx context.Context, source UpdatedBundleSource, trusted []spiffeid.TrustDomain,
+	tracker *rotation.Tracker, metrics *rotation.Metrics, taint *rotation.TaintDetector) {
+	rotation.ObserveTrustDomains(source, trusted, tracker, metrics, taint)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-source.Updated():
+			metrics.IncUpdates("bundle")
+			tracker.RecordUpdate("bundle")
+			rotation.ObserveTrustDomains(source, trusted, tracker, metrics, taint)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// RequestError is a request rejected before it is handled
+type RequestError struct {
+	Status  int
+	Code    string
+	Message string
+	Details []FieldError
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// Write writes the error envelope of e
+func (e *RequestError) Write(w http.ResponseWriter) {
+	WriteError(w, e.Status, e.Code, e.Message, e.Details...)
+}
+
+// DecodeJSON decodes a single JSON object from the body of r into v, unknown
+// fields and bodies larger than maxBodySize bytes are rejected
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v any, maxBodySize int64) *RequestError {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return decodeError(err)
+		}
+		return InvalidRequest("request body must contain a single JSON object")
+	}
+	return nil
+}
+
+// decodeError describes a decoding error without exposing decoder internals
+func decodeError(err error) *RequestError {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &RequestError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeBodyTooLarge,
+			Message: fmt.Sprintf("request body must not be larger than %d bytes", maxBytesErr.Limit),
+		}
+	case errors.Is(err, io.EOF):
+		return InvalidRequest("request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return InvalidRequest("request body is not valid JSON")
+	case errors.As(err, &syntaxErr):
+		return InvalidRequest(fmt.Sprintf("request body is not valid JSON at offset %d", syntaxErr.Offset))
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return InvalidRequest("request body must be a JSON object")
+		}
+		return InvalidFields(FieldError{Field: typeErr.Field, Message: fmt.Sprintf("must be a %s", jsonType(typeErr.Type.Kind()))})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return InvalidFields(FieldError{Field: field, Message: "is not a known field"})
+	}
+	return InvalidRequest("request body is not valid")
+}
+
+func InvalidRequest(message string) *RequestError {
+	return &RequestError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: message}
+}
+
+func InvalidFields(details ...FieldError) *RequestError {
+	return &RequestError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeValidationFailed,
+		Message: "request has invalid fields",
+		Details: details,
+	}
+}
+
+// jsonType names a Go kind as a JSON type
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Map, reflect.Struct, reflect.Pointer:
+		return "object"
+	}
+	return "number"
+}
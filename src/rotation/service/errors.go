@@ -0,0 +1,51 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes returned in the error envelope
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeValidationFailed = "validation_failed"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeUnauthenticated  = "unauthenticated"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeInternal         = "internal"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type APIError struct {
+	// Stable identifier of the error, see the code constants
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Invalid fields, only set for validation errors
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError describes why a request field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// WriteError writes the error envelope, messages are returned to callers
+// so they must not include internal details
+func WriteError(w http.ResponseWriter, status int, code, message string, details ...FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&ErrorResponse{Error: APIError{
+		Code:    code,
+		Message: message,
+		Details: details,
+	}})
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// Identity is the validated identity configuration of a service
+type Identity struct {
+	// Trust domain of the service
+	TrustDomain spiffeid.TrustDomain
+	// TrustDomain followed by the federated trust domains
+	Trusted []spiffeid.TrustDomain
+	// Audiences accepted in JWT-SVIDs, the first one is used when the
+	// service fetches its own JWT-SVID
+	Audiences []string
+}
+
+// ParseIdentity verifies the identity configuration of a service. The trust
+// domain defaults to "cluster.demo" and the audiences to "aud".
+func ParseIdentity(trustDomain string, federated, audiences []string) (*Identity, error) {
+	if trustDomain == "" {
+		trustDomain = "cluster.demo"
+	}
+	td, err := spiffeid.TrustDomainFromString(trustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust_domain %q: %w", trustDomain, err)
+	}
+
+	identity := &Identity{TrustDomain: td, Trusted: []spiffeid.TrustDomain{td}}
+	for _, rawTD := range federated {
+		federatedTD, err := spiffeid.TrustDomainFromString(rawTD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid federated trust domain %q: %w", rawTD, err)
+		}
+		if slices.Contains(identity.Trusted, federatedTD) {
+			return nil, fmt.Errorf("federated trust domain %q is repeated or is the service trust domain", rawTD)
+		}
+		identity.Trusted = append(identity.Trusted, federatedTD)
+	}
+
+	if len(audiences) == 0 {
+		audiences = []string{"aud"}
+	}
+	for i, audience := range audiences {
+		if strings.TrimSpace(audience) == "" {
+			return nil, fmt.Errorf("audience %d is empty", i)
+		}
+		if slices.Contains(audiences[:i], audience) {
+			return nil, fmt.Errorf("audience %q is repeated", audience)
+		}
+	}
+	identity.Audiences = audiences
+
+	return identity, nil
+}
+
+// TrustedBundles restricts a bundle source to the trusted trust domains, so
+// tokens issued by other trust domains are rejected even if the agent
+// provides their bundles
+type TrustedBundles struct {
+	Source       jwtbundle.Source
+	TrustDomains []spiffeid.TrustDomain
+}
+
+func (b *TrustedBundles) GetJWTBundleForTrustDomain(td spiffeid.TrustDomain) (*jwtbundle.Bundle, error) {
+	if !slices.Contains(b.TrustDomains, td) {
+		return nil, fmt.Errorf("trust domain %q is not trusted", td)
+	}
+	return b.Source.GetJWTBundleForTrustDomain(td)
+}
+
+// NewValidationsCounter counts JWT-SVID validations by result, "success" or
+// "failure"
+func NewValidationsCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_svid_validations_total",
+		Help: "Number of JWT-SVID validations, by result.",
+	}, []string{"result"})
+}
+
+type svidClaimsKey struct{}
+
+// WithSVIDClaims returns a context holding the claims of the validated
+// JWT-SVID of the caller
+func WithSVIDClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, svidClaimsKey{}, claims)
+}
+
+// SVIDClaims returns the claims stored by WithSVIDClaims, or nil
+func SVIDClaims(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(svidClaimsKey{}).(map[string]interface{})
+	return claims
+}
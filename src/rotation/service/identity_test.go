@@ -0,0 +1,107 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestParseIdentity(t *testing.T) {
+	tests := []struct {
+		name          string
+		trustDomain   string
+		federated     []string
+		audiences     []string
+		wantTD        string
+		wantTrusted   []string
+		wantAudiences []string
+		wantErr       string
+	}{
+		{
+			name:          "defaults",
+			wantTD:        "cluster.demo",
+			wantTrusted:   []string{"cluster.demo"},
+			wantAudiences: []string{"aud"},
+		},
+		{
+			name:          "federated trust domains",
+			trustDomain:   "api.demo",
+			federated:     []string{"client.demo", "partner.demo"},
+			audiences:     []string{"api", "reports"},
+			wantTD:        "api.demo",
+			wantTrusted:   []string{"api.demo", "client.demo", "partner.demo"},
+			wantAudiences: []string{"api", "reports"},
+		},
+		{
+			name:        "invalid trust domain",
+			trustDomain: "Cluster Demo",
+			wantErr:     `invalid trust_domain "Cluster Demo"`,
+		},
+		{
+			name:        "uppercase trust domain",
+			trustDomain: "Cluster.Demo",
+			wantErr:     `invalid trust_domain "Cluster.Demo"`,
+		},
+		{
+			name:      "invalid federated trust domain",
+			federated: []string{"client demo"},
+			wantErr:   `invalid federated trust domain "client demo"`,
+		},
+		{
+			name:      "federated service trust domain",
+			federated: []string{"cluster.demo"},
+			wantErr:   `federated trust domain "cluster.demo" is repeated or is the service trust domain`,
+		},
+		{
+			name:      "repeated federated trust domain",
+			federated: []string{"client.demo", "client.demo"},
+			wantErr:   `federated trust domain "client.demo" is repeated or is the service trust domain`,
+		},
+		{
+			name:      "empty audience",
+			audiences: []string{"aud", ""},
+			wantErr:   "audience 1 is empty",
+		},
+		{
+			name:      "blank audience",
+			audiences: []string{" "},
+			wantErr:   "audience 0 is empty",
+		},
+		{
+			name:      "repeated audience",
+			audiences: []string{"aud", "reports", "aud"},
+			wantErr:   `audience "aud" is repeated`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := ParseIdentity(tt.trustDomain, tt.federated, tt.audiences)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if identity.TrustDomain.String() != tt.wantTD {
+				t.Errorf("trust domain = %q, want %q", identity.TrustDomain, tt.wantTD)
+			}
+			var wantTrusted []spiffeid.TrustDomain
+			for _, rawTD := range tt.wantTrusted {
+				wantTrusted = append(wantTrusted, spiffeid.RequireTrustDomainFromString(rawTD))
+			}
+			if !slices.Equal(identity.Trusted, wantTrusted) {
+				t.Errorf("trusted = %v, want %v", identity.Trusted, wantTrusted)
+			}
+			if !slices.Equal(identity.Audiences, tt.wantAudiences) {
+				t.Errorf("audiences = %q, want %q", identity.Audiences, tt.wantAudiences)
+			}
+		})
+	}
+}
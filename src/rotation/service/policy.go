@@ -0,0 +1,159 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// PolicyConfig allows callers to access a route
+type PolicyConfig struct {
+	// Route as registered in the service router, e.g. "/customers" or the
+	// path template "/customers/{id:[0-9]+}"
+	Route string `hcl:"route"`
+	// HTTP methods, all methods are allowed when empty
+	Methods []string `hcl:"methods,optional"`
+	// SPIFFE IDs allowed to call the route
+	AllowedIDs []string `hcl:"allowed_ids,optional"`
+	// Regular expressions matched against the whole path of the caller
+	// SPIFFE ID, e.g. "/ns/client-ns/sa/[^/]+"
+	AllowedPathPatterns []string `hcl:"allowed_path_patterns,optional"`
+	// Trust domain of the callers matched by AllowedPathPatterns, required
+	// when patterns are set
+	AllowedTrustDomain string `hcl:"allowed_trust_domain,optional"`
+}
+
+type policy struct {
+	route       string
+	methods     []string
+	ids         []spiffeid.ID
+	trustDomain spiffeid.TrustDomain
+	patterns    []*regexp.Regexp
+}
+
+func (p *policy) matches(route, method string) bool {
+	return p.route == route && (len(p.methods) == 0 || slices.Contains(p.methods, method))
+}
+
+func (p *policy) allows(id spiffeid.ID) bool {
+	if slices.Contains(p.ids, id) {
+		return true
+	}
+	if !id.MemberOf(p.trustDomain) {
+		return false
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(id.Path()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorizer restricts routes to the SPIFFE IDs allowed by policies. The
+// caller is identified by the "sub" claim stored by WithSVIDClaims, so it
+// must run after the service authenticates the JWT-SVID.
+type Authorizer struct {
+	policies []*policy
+	log      *slog.Logger
+}
+
+func NewAuthorizer(configs []PolicyConfig, log *slog.Logger) (*Authorizer, error) {
+	a := &Authorizer{log: log}
+	for i, c := range configs {
+		if !strings.HasPrefix(c.Route, "/") {
+			return nil, fmt.Errorf("policy %d: route %q must start with /", i, c.Route)
+		}
+		if len(c.AllowedIDs) == 0 && len(c.AllowedPathPatterns) == 0 {
+			return nil, fmt.Errorf("policy %d: at least one allowed ID or path pattern is required", i)
+		}
+
+		p := &policy{route: c.Route}
+		for _, method := range c.Methods {
+			p.methods = append(p.methods, strings.ToUpper(method))
+		}
+		for _, rawID := range c.AllowedIDs {
+			id, err := spiffeid.FromString(rawID)
+			if err != nil {
+				return nil, fmt.Errorf("policy %d: invalid SPIFFE ID %q: %w", i, rawID, err)
+			}
+			p.ids = append(p.ids, id)
+		}
+		if len(c.AllowedPathPatterns) > 0 {
+			td, err := spiffeid.TrustDomainFromString(c.AllowedTrustDomain)
+			if err != nil {
+				return nil, fmt.Errorf("policy %d: invalid allowed trust domain %q: %w", i, c.AllowedTrustDomain, err)
+			}
+			p.trustDomain = td
+		}
+		for _, rawPattern := range c.AllowedPathPatterns {
+			// Anchored, so a pattern cannot match part of a path
+			pattern, err := regexp.Compile("^(?:" + rawPattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("policy %d: invalid path pattern %q: %w", i, rawPattern, err)
+			}
+			p.patterns = append(p.patterns, pattern)
+		}
+		a.policies = append(a.policies, p)
+	}
+
+	if len(a.policies) == 0 {
+		log.Warn("No authorization policies configured, any valid JWT-SVID is allowed")
+	}
+	return a, nil
+}
+
+// Middleware rejects requests not allowed by any policy. route returns the
+// route of a request matched against policies, when nil the request path is
+// used.
+func (a *Authorizer) Middleware(route func(req *http.Request) string) func(http.Handler) http.Handler {
+	if route == nil {
+		route = func(req *http.Request) string { return req.URL.Path }
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := a.Authorize(req, route(req)); err != nil {
+				a.log.Warn("Request denied", "route", req.URL.Path, "method", req.Method,
+					"sub", SVIDClaims(req.Context())["sub"], "reason", err)
+				WriteError(w, http.StatusForbidden, CodeForbidden, err.Error())
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// Authorize returns an error when no policy allows the caller of req to
+// use route with the request method
+func (a *Authorizer) Authorize(req *http.Request, route string) error {
+	if len(a.policies) == 0 {
+		return nil
+	}
+
+	sub, _ := SVIDClaims(req.Context())["sub"].(string)
+	id, err := spiffeid.FromString(sub)
+	if err != nil {
+		return fmt.Errorf("invalid subject %q", sub)
+	}
+
+	found := false
+	for _, p := range a.policies {
+		if !p.matches(route, req.Method) {
+			continue
+		}
+		found = true
+		if p.allows(id) {
+			return nil
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no policy allows %s %s", req.Method, route)
+	}
+	return fmt.Errorf("%q is not allowed to call %s %s", id, req.Method, route)
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewAuthorizer(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PolicyConfig
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			config: PolicyConfig{Route: "/customers", Methods: []string{"get"}, AllowedIDs: []string{"spiffe://cluster.demo/client"}},
+		},
+		{
+			name:    "relative route",
+			config:  PolicyConfig{Route: "customers", AllowedIDs: []string{"spiffe://cluster.demo/client"}},
+			wantErr: `policy 0: route "customers" must start with /`,
+		},
+		{
+			name:    "nobody allowed",
+			config:  PolicyConfig{Route: "/customers"},
+			wantErr: "policy 0: at least one allowed ID or path pattern is required",
+		},
+		{
+			name:    "invalid SPIFFE ID",
+			config:  PolicyConfig{Route: "/customers", AllowedIDs: []string{"client"}},
+			wantErr: `policy 0: invalid SPIFFE ID "client"`,
+		},
+		{
+			name:    "invalid path pattern",
+			config:  PolicyConfig{Route: "/customers", AllowedPathPatterns: []string{"/ns/("}, AllowedTrustDomain: "cluster.demo"},
+			wantErr: `policy 0: invalid path pattern "/ns/("`,
+		},
+		{
+			name:    "path pattern without trust domain",
+			config:  PolicyConfig{Route: "/customers", AllowedPathPatterns: []string{"/ns/client-ns/sa/[^/]+"}},
+			wantErr: `policy 0: invalid allowed trust domain ""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthorizer([]PolicyConfig{tt.config}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthorizerMiddleware(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	authz, err := NewAuthorizer([]PolicyConfig{
+		{
+			Route:      "/products",
+			Methods:    []string{"get"},
+			AllowedIDs: []string{"spiffe://cluster.demo/ns/client-ns/sa/default"},
+		},
+		{
+			Route:               "/products/{name}",
+			AllowedPathPatterns: []string{"/ns/client-ns/sa/[^/]+"},
+			AllowedTrustDomain:  "cluster.demo",
+		},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Requests under /products/ are matched by their template, as routers
+	// with path variables do
+	template := func(req *http.Request) string {
+		if strings.HasPrefix(req.URL.Path, "/products/") {
+			return "/products/{name}"
+		}
+		return req.URL.Path
+	}
+
+	tests := []struct {
+		name       string
+		route      func(req *http.Request) string
+		method     string
+		target     string
+		sub        string
+		wantStatus int
+		wantMsg    string
+	}{
+		{
+			name:       "allowed ID",
+			method:     http.MethodGet,
+			target:     "/products",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/default",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "method without policy",
+			method:     http.MethodPost,
+			target:     "/products",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/default",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    "no policy allows POST /products",
+		},
+		{
+			name:       "caller not allowed",
+			method:     http.MethodGet,
+			target:     "/products",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    `"spiffe://cluster.demo/ns/client-ns/sa/reporter" is not allowed to call GET /products`,
+		},
+		{
+			name:       "invalid subject",
+			method:     http.MethodGet,
+			target:     "/products",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    `invalid subject ""`,
+		},
+		{
+			name:       "path pattern on route template",
+			route:      template,
+			method:     http.MethodDelete,
+			target:     "/products/pencil",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "path pattern in another trust domain",
+			route:      template,
+			method:     http.MethodDelete,
+			target:     "/products/pencil",
+			sub:        "spiffe://other.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    `"spiffe://other.demo/ns/client-ns/sa/reporter" is not allowed to call DELETE /products/{name}`,
+		},
+		{
+			name:       "path pattern matching part of the path",
+			route:      template,
+			method:     http.MethodDelete,
+			target:     "/products/pencil",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter/extra",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    `"spiffe://cluster.demo/ns/client-ns/sa/reporter/extra" is not allowed to call DELETE /products/{name}`,
+		},
+		{
+			name:       "path pattern matching a path suffix",
+			route:      template,
+			method:     http.MethodDelete,
+			target:     "/products/pencil",
+			sub:        "spiffe://cluster.demo/evil/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    `"spiffe://cluster.demo/evil/ns/client-ns/sa/reporter" is not allowed to call DELETE /products/{name}`,
+		},
+		{
+			name:       "request path without route template",
+			method:     http.MethodDelete,
+			target:     "/products/pencil",
+			sub:        "spiffe://cluster.demo/ns/client-ns/sa/reporter",
+			wantStatus: http.StatusForbidden,
+			wantMsg:    "no policy allows DELETE /products/pencil",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := authz.Middleware(tt.route)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.sub != "" {
+				req = req.WithContext(WithSVIDClaims(req.Context(), map[string]interface{}{"sub": tt.sub}))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantMsg == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Code != CodeForbidden || resp.Error.Message != tt.wantMsg {
+				t.Errorf("error = %+v, want code %q and message %q", resp.Error, CodeForbidden, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestAuthorizerWithoutPolicies(t *testing.T) {
+	authz, err := NewAuthorizer(nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Any authenticated caller is allowed
+	if err := authz.Authorize(httptest.NewRequest(http.MethodGet, "/products", nil), "/products"); err != nil {
+		t.Fatalf("request denied without policies: %v", err)
+	}
+}
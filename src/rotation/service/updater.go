@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"rotation"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// UpdatedX509Source is an X509-SVID source that notifies updates, it is
+// implemented by workloadapi.X509Source
+type UpdatedX509Source interface {
+	x509svid.Source
+	x509bundle.Source
+	Updated() <-chan struct{}
+}
+
+// X509Updater reports every X509-SVID received from the Workload API to the
+// tracker, taint detector and metrics
+type X509Updater struct {
+	Source  UpdatedX509Source
+	Tracker *rotation.Tracker
+	Taint   *rotation.TaintDetector
+	Metrics *rotation.Metrics
+	// OnUpdate is optional, it is called with every SVID before it is
+	// observed and an error stops the update
+	OnUpdate func(svid *x509svid.SVID, bundle *x509bundle.Bundle) error
+	Log      *slog.Logger
+}
+
+// HandleUpdate observes the current SVID of the source
+func (u *X509Updater) HandleUpdate() error {
+	svid, err := u.Source.GetX509SVID()
+	if err != nil {
+		return fmt.Errorf("failed to get SVID: %w", err)
+	}
+	bundle, err := u.Source.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+	if err != nil {
+		return fmt.Errorf("failed to get bundle for trust domain: %w", err)
+	}
+
+	u.Log.Info("SVID received", "spiffe_id", svid.ID.String(),
+		"subject_key_id", rotation.KeyID(svid.Certificates[0].SubjectKeyId),
+		"authority_key_id", rotation.KeyID(svid.Certificates[0].AuthorityKeyId))
+
+	if u.OnUpdate != nil {
+		if err := u.OnUpdate(svid, bundle); err != nil {
+			return err
+		}
+	}
+
+	u.Tracker.ObserveX509(svid, bundle)
+	u.Taint.CheckX509(svid, bundle)
+	u.Metrics.ObserveX509(svid, bundle)
+
+	return nil
+}
+
+// Monitor handles every update notified by the source until ctx is done.
+// The source is not notified of the SVID received while it starts, so
+// callers handle it first.
+func (u *X509Updater) Monitor(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.Source.Updated():
+			u.Metrics.IncUpdates("x509")
+			u.Tracker.RecordUpdate("x509")
+			if err := u.HandleUpdate(); err != nil {
+				u.Log.Error("Failed to handle SVID update", "error", err)
+			}
+		}
+	}
+}
+
+// UpdatedJWTSource is a JWT-SVID source that notifies updates, it is
+// implemented by workloadapi.JWTSource
+type UpdatedJWTSource interface {
+	jwtbundle.Source
+	FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error)
+	Updated() <-chan struct{}
+}
+
+// JWTUpdater reports every JWT bundle received from the Workload API, and
+// the JWT-SVID fetched after it, to the tracker, taint detector and metrics
+type JWTUpdater struct {
+	Source      UpdatedJWTSource
+	TrustDomain spiffeid.TrustDomain
+	// Audience of the fetched JWT-SVID
+	Audience string
+	Tracker  *rotation.Tracker
+	Taint    *rotation.TaintDetector
+	Metrics  *rotation.Metrics
+	Log      *slog.Logger
+}
+
+// HandleUpdate observes the current JWT bundle and a new JWT-SVID
+func (u *JWTUpdater) HandleUpdate(ctx context.Context) error {
+	bundle, err := u.Source.GetJWTBundleForTrustDomain(u.TrustDomain)
+	if err != nil {
+		return fmt.Errorf("failed to get JWT bundle: %w", err)
+	}
+	u.Tracker.ObserveJWTBundle(bundle)
+	u.Metrics.ObserveJWTBundle(bundle)
+
+	svid, err := u.Source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: u.Audience})
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWT SVID: %w", err)
+	}
+	keyID, _ := rotation.JWTKeyID(svid.Marshal())
+	u.Log.Info("JWT SVID fetched", "key_id", keyID, "expiry", svid.Expiry)
+	u.Tracker.ObserveJWTSVID(svid)
+	u.Taint.CheckJWT(svid, bundle)
+
+	return nil
+}
+
+// Monitor handles the current JWT bundle and then every update notified by
+// the source, until ctx is done
+func (u *JWTUpdater) Monitor(ctx context.Context) {
+	// The source is not notified of the bundle received while it starts
+	if err := u.HandleUpdate(ctx); err != nil {
+		u.Log.Error("Failed to handle JWT update", "error", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.Source.Updated():
+			u.Metrics.IncUpdates("jwt")
+			u.Tracker.RecordUpdate("jwt")
+			if err := u.HandleUpdate(ctx); err != nil {
+				u.Log.Error("Failed to handle JWT update", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"rotation"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+var testTD = spiffeid.RequireTrustDomainFromString("cluster.demo")
+
+// fakeX509Source returns an SVID signed by the only authority of its bundle
+type fakeX509Source struct {
+	svid    *x509svid.SVID
+	bundle  *x509bundle.Bundle
+	updated chan struct{}
+}
+
+func newFakeX509Source() *fakeX509Source {
+	authority := &x509.Certificate{SubjectKeyId: []byte{0xa1}}
+	return &fakeX509Source{
+		svid: &x509svid.SVID{
+			ID: spiffeid.RequireFromPath(testTD, "/ns/api-ns/sa/default"),
+			Certificates: []*x509.Certificate{{
+				SerialNumber:   big.NewInt(1),
+				SubjectKeyId:   []byte{0x01},
+				AuthorityKeyId: authority.SubjectKeyId,
+				NotAfter:       time.Now().Add(time.Hour),
+			}},
+		},
+		bundle:  x509bundle.FromX509Authorities(testTD, []*x509.Certificate{authority}),
+		updated: make(chan struct{}),
+	}
+}
+
+func (s *fakeX509Source) GetX509SVID() (*x509svid.SVID, error) { return s.svid, nil }
+
+func (s *fakeX509Source) GetX509BundleForTrustDomain(spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	return s.bundle, nil
+}
+
+func (s *fakeX509Source) Updated() <-chan struct{} { return s.updated }
+
+// fakeJWTSource returns JWT-SVIDs with the key ID of the only authority of
+// its bundle, tokens are not signed
+type fakeJWTSource struct {
+	bundle  *jwtbundle.Bundle
+	updated chan struct{}
+}
+
+func newFakeJWTSource(t *testing.T) *fakeJWTSource {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := jwtbundle.New(testTD)
+	bundle.AddJWTAuthority("k1", key.Public())
+	return &fakeJWTSource{bundle: bundle, updated: make(chan struct{})}
+}
+
+func (s *fakeJWTSource) GetJWTBundleForTrustDomain(spiffeid.TrustDomain) (*jwtbundle.Bundle, error) {
+	return s.bundle, nil
+}
+
+func (s *fakeJWTSource) FetchJWTSVID(_ context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	token := encode([]byte(`{"alg":"ES256","kid":"k1","typ":"JWT"}`)) + "." +
+		encode([]byte(`{"sub":"spiffe://cluster.demo/ns/api-ns/sa/default","aud":["`+params.Audience+`"],"exp":4102444800}`)) + "." +
+		encode([]byte("signature"))
+	return jwtsvid.ParseInsecure(token, []string{params.Audience})
+}
+
+func (s *fakeJWTSource) Updated() <-chan struct{} { return s.updated }
+
+func newTestObservers() (*rotation.Tracker, *rotation.TaintDetector, *rotation.Metrics, *slog.Logger) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return rotation.NewTracker(log), rotation.NewTaintDetector(nil, log), rotation.NewMetrics(), log
+}
+
+func TestX509Updater(t *testing.T) {
+	source := newFakeX509Source()
+	tracker, taint, metrics, log := newTestObservers()
+	var stored *x509svid.SVID
+	var storeErr error
+	u := &X509Updater{
+		Source:  source,
+		Tracker: tracker,
+		Taint:   taint,
+		Metrics: metrics,
+		OnUpdate: func(svid *x509svid.SVID, _ *x509bundle.Bundle) error {
+			stored = svid
+			return storeErr
+		},
+		Log: log,
+	}
+
+	// A failure stops the update before the SVID is observed
+	storeErr = errors.New("disk full")
+	if err := u.HandleUpdate(); !errors.Is(err, storeErr) {
+		t.Fatalf("error = %v, want %v", err, storeErr)
+	}
+	if snapshot := tracker.Snapshot(); snapshot.X509SVID != nil {
+		t.Fatal("SVID observed after OnUpdate failed")
+	}
+
+	storeErr = nil
+	if err := u.HandleUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if stored != source.svid {
+		t.Fatal("OnUpdate was not called with the SVID")
+	}
+	if snapshot := tracker.Snapshot(); snapshot.X509SVID == nil || snapshot.X509SVID.AuthorityKeyID != "a1" {
+		t.Fatalf("tracked SVID = %+v, want signed by a1", snapshot.X509SVID)
+	}
+	if status := taint.Status().X509; status == nil || status.RefreshRequired {
+		t.Fatalf("taint status = %+v, want an SVID signed by a valid authority", status)
+	}
+
+	// Every notification is recorded and handled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.Monitor(ctx)
+	source.updated <- struct{}{}
+	source.updated <- struct{}{}
+	if updates := tracker.Snapshot().Updates; len(updates) < 1 || updates[0].Source != "x509" {
+		t.Fatalf("updates = %+v, want an x509 update", updates)
+	}
+}
+
+func TestJWTUpdater(t *testing.T) {
+	source := newFakeJWTSource(t)
+	tracker, taint, metrics, log := newTestObservers()
+	u := &JWTUpdater{
+		Source:      source,
+		TrustDomain: testTD,
+		Audience:    "aud",
+		Tracker:     tracker,
+		Taint:       taint,
+		Metrics:     metrics,
+		Log:         log,
+	}
+
+	// The current bundle is handled without waiting for a notification
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.Monitor(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for taint.Status().JWT == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("JWT-SVID was not checked on start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	snapshot := tracker.Snapshot()
+	if snapshot.JWTSVID == nil || snapshot.JWTSVID.KeyID != "k1" {
+		t.Fatalf("tracked JWT-SVID = %+v, want signed by k1", snapshot.JWTSVID)
+	}
+	if len(snapshot.Bundles) != 1 || len(snapshot.Bundles[0].JWTAuthorities) != 1 {
+		t.Fatalf("tracked bundles = %+v, want the k1 authority", snapshot.Bundles)
+	}
+	if status := taint.Status().JWT; status.AuthorityKeyID != "k1" || status.RefreshRequired {
+		t.Fatalf("taint status = %+v, want signed by a valid authority", status)
+	}
+
+	source.updated <- struct{}{}
+	source.updated <- struct{}{}
+	if updates := tracker.Snapshot().Updates; len(updates) < 1 || updates[0].Source != "jwt" {
+		t.Fatalf("updates = %+v, want a jwt update", updates)
+	}
+}
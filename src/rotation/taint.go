@@ -0,0 +1,210 @@
+package rotation
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// SVIDAuthorityStatus describes whether an SVID is signed by an authority
+// that is expected to remain valid
+type SVIDAuthorityStatus struct {
+	SPIFFEID       string `json:"spiffe_id"`
+	AuthorityKeyID string `json:"authority_key_id"`
+	// Tainted is true when the authority is in the operator supplied taint list
+	Tainted bool `json:"tainted"`
+	// InBundle is false when the authority is no longer in the latest bundle
+	InBundle bool `json:"in_bundle"`
+	// RefreshRequired is true when the SVID must be replaced before the
+	// authority is revoked
+	RefreshRequired bool      `json:"refresh_required"`
+	Reason          string    `json:"reason,omitempty"`
+	CheckedAt       time.Time `json:"checked_at"`
+}
+
+// TaintStatus is the last known state of both SVID types
+type TaintStatus struct {
+	TaintedAuthorities []string             `json:"tainted_authorities"`
+	X509               *SVIDAuthorityStatus `json:"x509,omitempty"`
+	JWT                *SVIDAuthorityStatus `json:"jwt,omitempty"`
+	// TrustDomains holds the authorities of every trusted trust domain
+	TrustDomains []TrustDomainStatus `json:"trust_domains,omitempty"`
+	// Verification is only set when expected authorities are requested
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// TaintDetector checks if the current SVIDs chain to a tainted authority, or
+// to one that is missing from the latest bundle. Every change of state is
+// logged, so it is possible to verify that a forced rotation moved the
+// workload away from the tainted key.
+type TaintDetector struct {
+	log     *slog.Logger
+	tainted []string
+
+	mu           sync.RWMutex
+	x509         *SVIDAuthorityStatus
+	jwt          *SVIDAuthorityStatus
+	trustDomains map[spiffeid.TrustDomain]TrustDomainStatus
+}
+
+// NewTaintDetector creates a detector for the provided tainted authority key IDs
+func NewTaintDetector(tainted []string, log *slog.Logger) *TaintDetector {
+	return &TaintDetector{
+		log:          log,
+		tainted:      slices.Clone(tainted),
+		trustDomains: make(map[spiffeid.TrustDomain]TrustDomainStatus),
+	}
+}
+
+// CheckX509 verifies the authority that signed the X509-SVID
+func (d *TaintDetector) CheckX509(svid *x509svid.SVID, bundle *x509bundle.Bundle) SVIDAuthorityStatus {
+	keyID := KeyID(svid.Certificates[0].AuthorityKeyId)
+	status := d.newStatus(svid.ID.String(), keyID,
+		slices.Contains(x509AuthorityKeyIDs(bundle.X509Authorities()), keyID))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logTransition("X509-SVID", d.x509, status)
+	d.x509 = &status
+
+	return status
+}
+
+// CheckJWT verifies the key used to sign the JWT-SVID
+func (d *TaintDetector) CheckJWT(svid *jwtsvid.SVID, bundle *jwtbundle.Bundle) SVIDAuthorityStatus {
+	keyID, err := JWTKeyID(svid.Marshal())
+	if err != nil {
+		d.log.Warn("Unable to get JWT-SVID key ID", "error", err)
+	}
+	_, inBundle := bundle.FindJWTAuthority(keyID)
+	status := d.newStatus(svid.ID.String(), keyID, inBundle)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logTransition("JWT-SVID", d.jwt, status)
+	d.jwt = &status
+
+	return status
+}
+
+// Status returns the last result of each check
+func (d *TaintDetector) Status() TaintStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	trustDomains := make([]TrustDomainStatus, 0, len(d.trustDomains))
+	for _, status := range d.trustDomains {
+		trustDomains = append(trustDomains, status)
+	}
+	slices.SortFunc(trustDomains, func(a, b TrustDomainStatus) int {
+		return strings.Compare(a.TrustDomain, b.TrustDomain)
+	})
+
+	return TaintStatus{
+		TaintedAuthorities: d.tainted,
+		X509:               d.x509,
+		JWT:                d.jwt,
+		TrustDomains:       trustDomains,
+	}
+}
+
+// ServeHTTP returns the current status as JSON. When the "x509_authority" or
+// "jwt_authority" query parameters are set the SVIDs are verified against
+// them, and 412 is returned if any of them is signed by another authority.
+func (d *TaintDetector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := d.Status()
+	code := http.StatusOK
+	query := r.URL.Query()
+	if query.Has("x509_authority") || query.Has("jwt_authority") {
+		status.Verification = d.verify(status, query.Get("x509_authority"), query.Get("jwt_authority"))
+		if !status.Verification.Passed {
+			code = http.StatusPreconditionFailed
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		d.log.Error("Failed to encode taint status", "error", err)
+	}
+}
+
+// Verification is the result of comparing the SVID authorities against the
+// expected ones, an empty expected authority is not verified
+type Verification struct {
+	X509Authority string `json:"x509_authority,omitempty"`
+	JWTAuthority  string `json:"jwt_authority,omitempty"`
+	Passed        bool   `json:"passed"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+func (d *TaintDetector) verify(status TaintStatus, x509Authority, jwtAuthority string) *Verification {
+	v := &Verification{
+		X509Authority: x509Authority,
+		JWTAuthority:  jwtAuthority,
+	}
+
+	switch {
+	case x509Authority != "" && status.X509 == nil:
+		v.Reason = "no X509-SVID observed"
+	case x509Authority != "" && status.X509.AuthorityKeyID != x509Authority:
+		v.Reason = fmt.Sprintf("X509-SVID is signed by %q", status.X509.AuthorityKeyID)
+	case jwtAuthority != "" && status.JWT == nil:
+		v.Reason = "no JWT-SVID observed"
+	case jwtAuthority != "" && status.JWT.AuthorityKeyID != jwtAuthority:
+		v.Reason = fmt.Sprintf("JWT-SVID is signed by %q", status.JWT.AuthorityKeyID)
+	default:
+		v.Passed = true
+	}
+	return v
+}
+
+func (d *TaintDetector) newStatus(id, keyID string, inBundle bool) SVIDAuthorityStatus {
+	status := SVIDAuthorityStatus{
+		SPIFFEID:       id,
+		AuthorityKeyID: keyID,
+		Tainted:        slices.Contains(d.tainted, keyID),
+		InBundle:       inBundle,
+		CheckedAt:      time.Now(),
+	}
+
+	switch {
+	case status.Tainted:
+		status.Reason = "authority is tainted"
+	case !status.InBundle:
+		status.Reason = "authority is not in the latest bundle"
+	}
+	status.RefreshRequired = status.Reason != ""
+
+	return status
+}
+
+func (d *TaintDetector) logTransition(svidType string, old *SVIDAuthorityStatus, current SVIDAuthorityStatus) {
+	switch {
+	case current.RefreshRequired:
+		if old != nil && old.RefreshRequired && old.AuthorityKeyID == current.AuthorityKeyID {
+			return
+		}
+		d.log.Warn("SVID must be refreshed", "type", svidType, "spiffe_id", current.SPIFFEID,
+			"authority_key_id", current.AuthorityKeyID, "reason", current.Reason)
+	case old != nil && old.RefreshRequired:
+		d.log.Info("SVID moved to a valid authority", "type", svidType, "spiffe_id", current.SPIFFEID,
+			"old_authority_key_id", old.AuthorityKeyID, "authority_key_id", current.AuthorityKeyID)
+	}
+}
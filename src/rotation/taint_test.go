@@ -0,0 +1,205 @@
+package rotation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// wantStatus is the part of an SVIDAuthorityStatus compared by tests
+type wantStatus struct {
+	AuthorityKeyID  string
+	Tainted         bool
+	InBundle        bool
+	RefreshRequired bool
+	Reason          string
+}
+
+func checkStatus(t *testing.T, status SVIDAuthorityStatus, want wantStatus) {
+	t.Helper()
+	got := wantStatus{
+		AuthorityKeyID:  status.AuthorityKeyID,
+		Tainted:         status.Tainted,
+		InBundle:        status.InBundle,
+		RefreshRequired: status.RefreshRequired,
+		Reason:          status.Reason,
+	}
+	if got != want {
+		t.Errorf("status = %+v, want %+v", got, want)
+	}
+	if status.SPIFFEID != testID.String() {
+		t.Errorf("SPIFFE ID = %q, want %q", status.SPIFFEID, testID)
+	}
+}
+
+func TestTaintDetectorCheckX509(t *testing.T) {
+	tests := []struct {
+		name    string
+		tainted []string
+		svid    *x509svid.SVID
+		bundle  *x509bundle.Bundle
+		want    wantStatus
+	}{
+		{
+			name:   "untainted authority",
+			svid:   testX509SVID(0xa1, 0x01),
+			bundle: testX509Bundle(0xa1, 0xb2),
+			want:   wantStatus{AuthorityKeyID: "a1", InBundle: true},
+		},
+		{
+			name:    "another authority tainted",
+			tainted: []string{"b2"},
+			svid:    testX509SVID(0xa1, 0x01),
+			bundle:  testX509Bundle(0xa1, 0xb2),
+			want:    wantStatus{AuthorityKeyID: "a1", InBundle: true},
+		},
+		{
+			name:    "tainted authority",
+			tainted: []string{"b2", "a1"},
+			svid:    testX509SVID(0xa1, 0x01),
+			bundle:  testX509Bundle(0xa1, 0xb2),
+			want: wantStatus{AuthorityKeyID: "a1", Tainted: true, InBundle: true, RefreshRequired: true,
+				Reason: "authority is tainted"},
+		},
+		{
+			name:   "authority not in bundle",
+			svid:   testX509SVID(0xa1, 0x01),
+			bundle: testX509Bundle(0xb2),
+			want:   wantStatus{AuthorityKeyID: "a1", RefreshRequired: true, Reason: "authority is not in the latest bundle"},
+		},
+		{
+			name:    "tainted authority not in bundle",
+			tainted: []string{"a1"},
+			svid:    testX509SVID(0xa1, 0x01),
+			bundle:  testX509Bundle(0xb2),
+			want:    wantStatus{AuthorityKeyID: "a1", Tainted: true, RefreshRequired: true, Reason: "authority is tainted"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewTaintDetector(tt.tainted, testLogger())
+			status := d.CheckX509(tt.svid, tt.bundle)
+			checkStatus(t, status, tt.want)
+			if last := d.Status().X509; last == nil || *last != status {
+				t.Errorf("last status = %+v, want %+v", last, status)
+			}
+		})
+	}
+}
+
+func TestTaintDetectorCheckJWT(t *testing.T) {
+	tests := []struct {
+		name    string
+		tainted []string
+		svid    *jwtsvid.SVID
+		bundle  *jwtbundle.Bundle
+		want    wantStatus
+	}{
+		{
+			name:   "untainted authority",
+			svid:   testJWTSVID(t, "k1"),
+			bundle: testJWTBundle(t, "k1", "k2"),
+			want:   wantStatus{AuthorityKeyID: "k1", InBundle: true},
+		},
+		{
+			name:    "tainted authority",
+			tainted: []string{"k1"},
+			svid:    testJWTSVID(t, "k1"),
+			bundle:  testJWTBundle(t, "k1", "k2"),
+			want: wantStatus{AuthorityKeyID: "k1", Tainted: true, InBundle: true, RefreshRequired: true,
+				Reason: "authority is tainted"},
+		},
+		{
+			name:   "authority not in bundle",
+			svid:   testJWTSVID(t, "k1"),
+			bundle: testJWTBundle(t, "k2"),
+			want:   wantStatus{AuthorityKeyID: "k1", RefreshRequired: true, Reason: "authority is not in the latest bundle"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewTaintDetector(tt.tainted, testLogger())
+			status := d.CheckJWT(tt.svid, tt.bundle)
+			checkStatus(t, status, tt.want)
+			if last := d.Status().JWT; last == nil || *last != status {
+				t.Errorf("last status = %+v, want %+v", last, status)
+			}
+		})
+	}
+}
+
+// TestTaintDetectorRotation follows a forced rotation away from a tainted
+// authority
+func TestTaintDetectorRotation(t *testing.T) {
+	d := NewTaintDetector([]string{"a1"}, testLogger())
+
+	checkStatus(t, d.CheckX509(testX509SVID(0xa1, 0x01), testX509Bundle(0xa1, 0xb2)),
+		wantStatus{AuthorityKeyID: "a1", Tainted: true, InBundle: true, RefreshRequired: true, Reason: "authority is tainted"})
+	checkStatus(t, d.CheckX509(testX509SVID(0xb2, 0x02), testX509Bundle(0xa1, 0xb2)),
+		wantStatus{AuthorityKeyID: "b2", InBundle: true})
+	checkStatus(t, d.CheckX509(testX509SVID(0xb2, 0x02), testX509Bundle(0xb2)),
+		wantStatus{AuthorityKeyID: "b2", InBundle: true})
+}
+
+func TestTaintDetectorVerification(t *testing.T) {
+	d := NewTaintDetector(nil, testLogger())
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantReason string
+	}{
+		{
+			name:       "no JWT-SVID observed",
+			query:      "?x509_authority=b2&jwt_authority=k2",
+			wantStatus: http.StatusPreconditionFailed,
+			wantReason: "no JWT-SVID observed",
+		},
+		{
+			name:       "X509-SVID signed by another authority",
+			query:      "?x509_authority=a1",
+			wantStatus: http.StatusPreconditionFailed,
+			wantReason: `X509-SVID is signed by "b2"`,
+		},
+		{
+			name:       "expected X509 authority",
+			query:      "?x509_authority=b2",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	d.CheckX509(testX509SVID(0xb2, 0x02), testX509Bundle(0xa1, 0xb2))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status/authority"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var status TaintStatus
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Verification == nil || status.Verification.Reason != tt.wantReason {
+				t.Errorf("verification = %+v, want reason %q", status.Verification, tt.wantReason)
+			}
+		})
+	}
+
+	d.CheckJWT(testJWTSVID(t, "k2"), testJWTBundle(t, "k1", "k2"))
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status/authority?x509_authority=b2&jwt_authority=k2", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d after both SVIDs rotated, want %d", rec.Code, http.StatusOK)
+	}
+}
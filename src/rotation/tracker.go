@@ -0,0 +1,290 @@
+package rotation
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// EventType describes what changed between two observations
+type EventType string
+
+const (
+	// X509AuthorityAdded is emitted when a new X.509 authority appears in the bundle
+	X509AuthorityAdded EventType = "x509_authority_added"
+	// X509AuthorityRemoved is emitted when an X.509 authority is no longer in the bundle
+	X509AuthorityRemoved EventType = "x509_authority_removed"
+	// JWTAuthorityAdded is emitted when a new JWT authority appears in the bundle
+	JWTAuthorityAdded EventType = "jwt_authority_added"
+	// JWTAuthorityRemoved is emitted when a JWT authority is no longer in the bundle
+	JWTAuthorityRemoved EventType = "jwt_authority_removed"
+	// SVIDAuthorityChanged is emitted when the X509-SVID is signed by a different authority
+	SVIDAuthorityChanged EventType = "svid_authority_changed"
+	// SVIDKeyChanged is emitted when the X509-SVID subject key ID changes
+	SVIDKeyChanged EventType = "svid_key_changed"
+	// JWTSVIDKeyChanged is emitted when JWT-SVIDs are signed with a different key ID
+	JWTSVIDKeyChanged EventType = "jwt_svid_key_changed"
+)
+
+// Event is a single change observed by the Tracker
+type Event struct {
+	Type        EventType `json:"type"`
+	TrustDomain string    `json:"trust_domain"`
+	SPIFFEID    string    `json:"spiffe_id,omitempty"`
+	Old         string    `json:"old,omitempty"`
+	New         string    `json:"new,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Tracker keeps the last observed X.509 and JWT state and reports the
+// differences on every new observation. The first observation is reported
+// as changes from an empty state.
+type Tracker struct {
+	log *slog.Logger
+
+	mu              sync.Mutex
+	x509Authorities map[spiffeid.TrustDomain][]string
+	jwtAuthorities  map[spiffeid.TrustDomain][]string
+	svidAuthority   string
+	svidKey         string
+	jwtSVIDKey      string
+
+	// Last observed values, reported by Snapshot
+	x509SVID    *x509svid.SVID
+	jwtSVID     *jwtsvid.SVID
+	x509Bundles map[spiffeid.TrustDomain]*x509bundle.Bundle
+	jwtBundles  map[spiffeid.TrustDomain]*jwtbundle.Bundle
+	updates     []Update
+	events      []Event
+	subscribers map[chan Event]struct{}
+}
+
+// NewTracker creates a new Tracker that logs every event using log
+func NewTracker(log *slog.Logger) *Tracker {
+	return &Tracker{
+		log:             log,
+		x509Authorities: make(map[spiffeid.TrustDomain][]string),
+		jwtAuthorities:  make(map[spiffeid.TrustDomain][]string),
+		x509Bundles:     make(map[spiffeid.TrustDomain]*x509bundle.Bundle),
+		jwtBundles:      make(map[spiffeid.TrustDomain]*jwtbundle.Bundle),
+		subscribers:     make(map[chan Event]struct{}),
+	}
+}
+
+// ObserveX509 compares the X509-SVID and its trust domain bundle against the
+// previous observation
+func (t *Tracker) ObserveX509(svid *x509svid.SVID, bundle *x509bundle.Bundle) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	td := bundle.TrustDomain()
+
+	authorities := x509AuthorityKeyIDs(bundle.X509Authorities())
+	events := diffAuthorities(td, t.x509Authorities[td], authorities, X509AuthorityAdded, X509AuthorityRemoved, now)
+	t.x509Authorities[td] = authorities
+	t.x509Bundles[td] = bundle
+	t.x509SVID = svid
+
+	leaf := svid.Certificates[0]
+	if aki := KeyID(leaf.AuthorityKeyId); aki != t.svidAuthority {
+		events = append(events, Event{
+			Type:        SVIDAuthorityChanged,
+			TrustDomain: svid.ID.TrustDomain().String(),
+			SPIFFEID:    svid.ID.String(),
+			Old:         t.svidAuthority,
+			New:         aki,
+			Time:        now,
+		})
+		t.svidAuthority = aki
+	}
+	if ski := KeyID(leaf.SubjectKeyId); ski != t.svidKey {
+		events = append(events, Event{
+			Type:        SVIDKeyChanged,
+			TrustDomain: svid.ID.TrustDomain().String(),
+			SPIFFEID:    svid.ID.String(),
+			Old:         t.svidKey,
+			New:         ski,
+			Time:        now,
+		})
+		t.svidKey = ski
+	}
+
+	t.recordEvents(events)
+	return events
+}
+
+// ObserveX509Bundle compares X.509 authorities against the previous
+// observation of the same trust domain, without looking at the SVID
+func (t *Tracker) ObserveX509Bundle(bundle *x509bundle.Bundle) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	td := bundle.TrustDomain()
+	authorities := x509AuthorityKeyIDs(bundle.X509Authorities())
+	events := diffAuthorities(td, t.x509Authorities[td], authorities, X509AuthorityAdded, X509AuthorityRemoved, time.Now())
+	t.x509Authorities[td] = authorities
+	t.x509Bundles[td] = bundle
+
+	t.recordEvents(events)
+	return events
+}
+
+// ObserveJWTBundle compares JWT authorities against the previous observation
+// of the same trust domain
+func (t *Tracker) ObserveJWTBundle(bundle *jwtbundle.Bundle) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	td := bundle.TrustDomain()
+	authorities := jwtAuthorityKeyIDs(bundle)
+
+	events := diffAuthorities(td, t.jwtAuthorities[td], authorities, JWTAuthorityAdded, JWTAuthorityRemoved, time.Now())
+	t.jwtAuthorities[td] = authorities
+	t.jwtBundles[td] = bundle
+
+	t.recordEvents(events)
+	return events
+}
+
+// ObserveJWTSVID reports when JWT-SVIDs start being signed with a different key
+func (t *Tracker) ObserveJWTSVID(svid *jwtsvid.SVID) []Event {
+	keyID, err := JWTKeyID(svid.Marshal())
+	if err != nil {
+		t.log.Warn("Unable to get JWT-SVID key ID", "error", err)
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.jwtSVID = svid
+	if keyID == t.jwtSVIDKey {
+		return nil
+	}
+	events := []Event{{
+		Type:        JWTSVIDKeyChanged,
+		TrustDomain: svid.ID.TrustDomain().String(),
+		SPIFFEID:    svid.ID.String(),
+		Old:         t.jwtSVIDKey,
+		New:         keyID,
+		Time:        time.Now(),
+	}}
+	t.jwtSVIDKey = keyID
+
+	t.recordEvents(events)
+	return events
+}
+
+// recordEvents logs events and adds them to the history, the caller must
+// hold the lock
+func (t *Tracker) recordEvents(events []Event) {
+	t.events = append(t.events, events...)
+	if len(t.events) > eventHistorySize {
+		t.events = slices.Clone(t.events[len(t.events)-eventHistorySize:])
+	}
+
+	for _, e := range events {
+		for ch := range t.subscribers {
+			select {
+			case ch <- e:
+			default:
+				t.log.Warn("Rotation event dropped, subscriber is not reading", "type", e.Type)
+			}
+		}
+		t.log.Info("Rotation event", "type", e.Type, "trust_domain", e.TrustDomain,
+			"spiffe_id", e.SPIFFEID, "old", e.Old, "new", e.New)
+	}
+}
+
+// Subscribe returns a channel that receives every new event. The returned
+// function must be called to stop receiving events. Events are dropped if
+// the subscriber does not keep up.
+func (t *Tracker) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBufferSize)
+
+	t.mu.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mu.Unlock()
+
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subscribers, ch)
+		t.mu.Unlock()
+	}
+}
+
+func diffAuthorities(td spiffeid.TrustDomain, old, current []string, added, removed EventType, now time.Time) []Event {
+	var events []Event
+	for _, keyID := range current {
+		if !slices.Contains(old, keyID) {
+			events = append(events, Event{Type: added, TrustDomain: td.String(), New: keyID, Time: now})
+		}
+	}
+	for _, keyID := range old {
+		if !slices.Contains(current, keyID) {
+			events = append(events, Event{Type: removed, TrustDomain: td.String(), Old: keyID, Time: now})
+		}
+	}
+	return events
+}
+
+func x509AuthorityKeyIDs(authorities []*x509.Certificate) []string {
+	keyIDs := make([]string, 0, len(authorities))
+	for _, authority := range authorities {
+		keyIDs = append(keyIDs, KeyID(authority.SubjectKeyId))
+	}
+	slices.Sort(keyIDs)
+	return keyIDs
+}
+
+func jwtAuthorityKeyIDs(bundle *jwtbundle.Bundle) []string {
+	keyIDs := make([]string, 0, len(bundle.JWTAuthorities()))
+	for keyID := range bundle.JWTAuthorities() {
+		keyIDs = append(keyIDs, keyID)
+	}
+	slices.Sort(keyIDs)
+	return keyIDs
+}
+
+// KeyID formats a subject or authority key ID as an hex string
+func KeyID(ski []byte) string {
+	serialHex := fmt.Sprintf("%x", ski)
+	if len(serialHex)%2 == 1 {
+		serialHex = "0" + serialHex
+	}
+
+	return serialHex
+}
+
+// JWTKeyID returns the "kid" header of a JWT without validating it
+func JWTKeyID(token string) (string, error) {
+	header, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", fmt.Errorf("malformed token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token header: %w", err)
+	}
+
+	var h struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return "", fmt.Errorf("failed to parse token header: %w", err)
+	}
+	return h.KeyID, nil
+}
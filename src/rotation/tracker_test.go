@@ -0,0 +1,273 @@
+package rotation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+var (
+	testTD = spiffeid.RequireTrustDomainFromString("cluster.demo")
+	testID = spiffeid.RequireFromPath(testTD, "/ns/api-ns/sa/default")
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testAuthority returns an X.509 authority with subject key ID keyID, only
+// the fields read by the package are set
+func testAuthority(keyID byte) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "authority " + KeyID([]byte{keyID})},
+		SubjectKeyId: []byte{keyID},
+		NotBefore:    time.Date(2024, 1, 1, 0, 0, int(keyID), 0, time.UTC),
+		NotAfter:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func testX509Bundle(keyIDs ...byte) *x509bundle.Bundle {
+	var authorities []*x509.Certificate
+	for _, keyID := range keyIDs {
+		authorities = append(authorities, testAuthority(keyID))
+	}
+	return x509bundle.FromX509Authorities(testTD, authorities)
+}
+
+// testX509SVID returns an X509-SVID with subject key ID key signed by authority
+func testX509SVID(authority, key byte) *x509svid.SVID {
+	return &x509svid.SVID{
+		ID: testID,
+		Certificates: []*x509.Certificate{{
+			Subject:        pkix.Name{CommonName: "svid"},
+			SerialNumber:   big.NewInt(int64(key)),
+			SubjectKeyId:   []byte{key},
+			AuthorityKeyId: []byte{authority},
+			NotBefore:      time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+			NotAfter:       time.Date(2024, 6, 1, 1, 0, 0, 0, time.UTC),
+		}},
+	}
+}
+
+func testJWTBundle(t *testing.T, keyIDs ...string) *jwtbundle.Bundle {
+	t.Helper()
+	bundle := jwtbundle.New(testTD)
+	for _, keyID := range keyIDs {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle.AddJWTAuthority(keyID, key.Public())
+	}
+	return bundle
+}
+
+// testJWTSVID returns a JWT-SVID with keyID in its header, the token is not
+// signed since the package never validates it
+func testJWTSVID(t *testing.T, keyID string) *jwtsvid.SVID {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	token := encode(map[string]string{"alg": "ES256", "typ": "JWT", "kid": keyID}) + "." +
+		encode(map[string]any{"sub": testID.String(), "aud": []string{"aud"}, "exp": time.Now().Add(time.Hour).Unix()}) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("signature"))
+
+	svid, err := jwtsvid.ParseInsecure(token, []string{"aud"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svid
+}
+
+// eventDiff is the part of an event compared by tests
+type eventDiff struct {
+	Type EventType
+	Old  string
+	New  string
+}
+
+func eventDiffs(events []Event) []eventDiff {
+	var diffs []eventDiff
+	for _, e := range events {
+		diffs = append(diffs, eventDiff{Type: e.Type, Old: e.Old, New: e.New})
+	}
+	return diffs
+}
+
+func TestTrackerObserveX509(t *testing.T) {
+	tracker := NewTracker(testLogger())
+
+	steps := []struct {
+		name       string
+		svid       *x509svid.SVID
+		bundle     *x509bundle.Bundle
+		wantEvents []eventDiff
+	}{
+		{
+			name:   "first observation",
+			svid:   testX509SVID(0xa1, 0x01),
+			bundle: testX509Bundle(0xa1),
+			wantEvents: []eventDiff{
+				{Type: X509AuthorityAdded, New: "a1"},
+				{Type: SVIDAuthorityChanged, New: "a1"},
+				{Type: SVIDKeyChanged, New: "01"},
+			},
+		},
+		{
+			name:   "nothing changed",
+			svid:   testX509SVID(0xa1, 0x01),
+			bundle: testX509Bundle(0xa1),
+		},
+		{
+			name:       "authority prepared",
+			svid:       testX509SVID(0xa1, 0x01),
+			bundle:     testX509Bundle(0xa1, 0xb2),
+			wantEvents: []eventDiff{{Type: X509AuthorityAdded, New: "b2"}},
+		},
+		{
+			name:   "SVID signed by the new authority",
+			svid:   testX509SVID(0xb2, 0x02),
+			bundle: testX509Bundle(0xa1, 0xb2),
+			wantEvents: []eventDiff{
+				{Type: SVIDAuthorityChanged, Old: "a1", New: "b2"},
+				{Type: SVIDKeyChanged, Old: "01", New: "02"},
+			},
+		},
+		{
+			name:       "SVID key rotated",
+			svid:       testX509SVID(0xb2, 0x03),
+			bundle:     testX509Bundle(0xa1, 0xb2),
+			wantEvents: []eventDiff{{Type: SVIDKeyChanged, Old: "02", New: "03"}},
+		},
+		{
+			name:       "old authority revoked",
+			svid:       testX509SVID(0xb2, 0x03),
+			bundle:     testX509Bundle(0xb2),
+			wantEvents: []eventDiff{{Type: X509AuthorityRemoved, Old: "a1"}},
+		},
+	}
+
+	var history []eventDiff
+	for _, step := range steps {
+		events := eventDiffs(tracker.ObserveX509(step.svid, step.bundle))
+		if !slices.Equal(events, step.wantEvents) {
+			t.Fatalf("%s: events = %+v, want %+v", step.name, events, step.wantEvents)
+		}
+		history = append(history, events...)
+	}
+	if events := eventDiffs(tracker.Snapshot().Events); !slices.Equal(events, history) {
+		t.Fatalf("snapshot events = %+v, want %+v", events, history)
+	}
+}
+
+func TestTrackerObserveJWT(t *testing.T) {
+	tracker := NewTracker(testLogger())
+
+	steps := []struct {
+		name       string
+		observe    func() []Event
+		wantEvents []eventDiff
+	}{
+		{
+			name:       "first bundle",
+			observe:    func() []Event { return tracker.ObserveJWTBundle(testJWTBundle(t, "k1")) },
+			wantEvents: []eventDiff{{Type: JWTAuthorityAdded, New: "k1"}},
+		},
+		{
+			name:       "first JWT-SVID",
+			observe:    func() []Event { return tracker.ObserveJWTSVID(testJWTSVID(t, "k1")) },
+			wantEvents: []eventDiff{{Type: JWTSVIDKeyChanged, New: "k1"}},
+		},
+		{
+			name:    "JWT-SVID signed with the same key",
+			observe: func() []Event { return tracker.ObserveJWTSVID(testJWTSVID(t, "k1")) },
+		},
+		{
+			name:       "authority prepared",
+			observe:    func() []Event { return tracker.ObserveJWTBundle(testJWTBundle(t, "k1", "k2")) },
+			wantEvents: []eventDiff{{Type: JWTAuthorityAdded, New: "k2"}},
+		},
+		{
+			name:       "JWT-SVID signed by the new authority",
+			observe:    func() []Event { return tracker.ObserveJWTSVID(testJWTSVID(t, "k2")) },
+			wantEvents: []eventDiff{{Type: JWTSVIDKeyChanged, Old: "k1", New: "k2"}},
+		},
+		{
+			name:       "old authority revoked",
+			observe:    func() []Event { return tracker.ObserveJWTBundle(testJWTBundle(t, "k2")) },
+			wantEvents: []eventDiff{{Type: JWTAuthorityRemoved, Old: "k1"}},
+		},
+	}
+
+	for _, step := range steps {
+		if events := eventDiffs(step.observe()); !slices.Equal(events, step.wantEvents) {
+			t.Fatalf("%s: events = %+v, want %+v", step.name, events, step.wantEvents)
+		}
+	}
+}
+
+// TestTrackerTrustDomains verifies authorities are compared per trust domain
+func TestTrackerTrustDomains(t *testing.T) {
+	tracker := NewTracker(testLogger())
+	tracker.ObserveX509Bundle(testX509Bundle(0xa1))
+
+	federated := x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("other.demo"),
+		[]*x509.Certificate{testAuthority(0xc3)})
+	events := tracker.ObserveX509Bundle(federated)
+	if len(events) != 1 || events[0].TrustDomain != "other.demo" || events[0].New != "c3" {
+		t.Fatalf("events = %+v, want c3 added to other.demo", events)
+	}
+	if events := tracker.ObserveX509Bundle(testX509Bundle(0xa1)); len(events) != 0 {
+		t.Fatalf("events = %+v, want none", events)
+	}
+}
+
+func TestTrackerSubscribe(t *testing.T) {
+	tracker := NewTracker(testLogger())
+	events, unsubscribe := tracker.Subscribe()
+
+	tracker.ObserveX509Bundle(testX509Bundle(0xa1))
+	select {
+	case e := <-events:
+		if e.Type != X509AuthorityAdded || e.New != "a1" {
+			t.Fatalf("event = %+v, want a1 added", e)
+		}
+	default:
+		t.Fatal("subscriber did not receive the event")
+	}
+
+	// A subscriber that does not read does not block observations
+	for i := range subscriberBufferSize + 1 {
+		tracker.ObserveX509Bundle(testX509Bundle(byte(i)))
+	}
+
+	unsubscribe()
+	for len(events) > 0 {
+		<-events
+	}
+	tracker.ObserveX509Bundle(testX509Bundle(0xff))
+	if len(events) != 0 {
+		t.Fatal("event received after unsubscribing")
+	}
+}
@@ -0,0 +1,104 @@
+package rotation
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// BundleSource provides X.509 and JWT bundles by trust domain, it is
+// implemented by workloadapi.BundleSource
+type BundleSource interface {
+	x509bundle.Source
+	jwtbundle.Source
+}
+
+// MatchMemberOfAny matches IDs that belong to any of the trust domains
+func MatchMemberOfAny(trustDomains []spiffeid.TrustDomain) spiffeid.Matcher {
+	return func(id spiffeid.ID) error {
+		if slices.ContainsFunc(trustDomains, id.MemberOf) {
+			return nil
+		}
+		return fmt.Errorf("unexpected trust domain %q", id.TrustDomain())
+	}
+}
+
+// TrustDomainStatus is the last known set of authorities of a trust domain
+type TrustDomainStatus struct {
+	TrustDomain     string   `json:"trust_domain"`
+	X509Authorities []string `json:"x509_authorities"`
+	JWTAuthorities  []string `json:"jwt_authorities"`
+	// TaintedAuthorities are tainted authorities still present in the bundle
+	TaintedAuthorities []string  `json:"tainted_authorities,omitempty"`
+	Error              string    `json:"error,omitempty"`
+	CheckedAt          time.Time `json:"checked_at"`
+}
+
+// CheckTrustDomain records the authorities of td and logs when they change
+func (d *TaintDetector) CheckTrustDomain(td spiffeid.TrustDomain, source BundleSource) TrustDomainStatus {
+	status := TrustDomainStatus{
+		TrustDomain: td.String(),
+		CheckedAt:   time.Now(),
+	}
+
+	x509Bundle, x509Err := source.GetX509BundleForTrustDomain(td)
+	if x509Err == nil {
+		status.X509Authorities = x509AuthorityKeyIDs(x509Bundle.X509Authorities())
+	}
+	jwtBundle, jwtErr := source.GetJWTBundleForTrustDomain(td)
+	if jwtErr == nil {
+		status.JWTAuthorities = jwtAuthorityKeyIDs(jwtBundle)
+	}
+	switch {
+	case x509Err != nil:
+		status.Error = x509Err.Error()
+	case jwtErr != nil:
+		status.Error = jwtErr.Error()
+	}
+
+	for _, keyID := range slices.Concat(status.X509Authorities, status.JWTAuthorities) {
+		if slices.Contains(d.tainted, keyID) {
+			status.TaintedAuthorities = append(status.TaintedAuthorities, keyID)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old, ok := d.trustDomains[td]
+	d.trustDomains[td] = status
+
+	switch {
+	case status.Error != "":
+		if !ok || old.Error != status.Error {
+			d.log.Warn("Trust domain bundle not available", "trust_domain", td, "error", status.Error)
+		}
+	case !ok || !slices.Equal(old.X509Authorities, status.X509Authorities) ||
+		!slices.Equal(old.JWTAuthorities, status.JWTAuthorities):
+		d.log.Info("Trust domain authorities", "trust_domain", td,
+			"x509_authorities", status.X509Authorities, "jwt_authorities", status.JWTAuthorities,
+			"tainted_authorities", status.TaintedAuthorities)
+	}
+
+	return status
+}
+
+// ObserveTrustDomains reports the bundles of every trust domain to the
+// tracker, metrics and taint detector. Trust domains without a bundle are
+// only reported to the taint detector.
+func ObserveTrustDomains(source BundleSource, trustDomains []spiffeid.TrustDomain, tracker *Tracker, metrics *Metrics, taint *TaintDetector) {
+	for _, td := range trustDomains {
+		if x509Bundle, err := source.GetX509BundleForTrustDomain(td); err == nil {
+			tracker.ObserveX509Bundle(x509Bundle)
+			metrics.ObserveX509Bundle(x509Bundle)
+		}
+		if jwtBundle, err := source.GetJWTBundleForTrustDomain(td); err == nil {
+			tracker.ObserveJWTBundle(jwtBundle)
+			metrics.ObserveJWTBundle(jwtBundle)
+		}
+		taint.CheckTrustDomain(td, source)
+	}
+}
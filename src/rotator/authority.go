@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	bundlev1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/bundle/v1"
+	localauthorityv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/localauthority/v1"
+	"github.com/spiffe/spire-api-sdk/proto/spire/api/types"
+	"google.golang.org/grpc"
+)
+
+// authorityState is the state of the local authorities of a single type, any
+// of them can be nil
+type authorityState struct {
+	active   *localauthorityv1.AuthorityState
+	prepared *localauthorityv1.AuthorityState
+	old      *localauthorityv1.AuthorityState
+}
+
+// authorityManager manages the authorities of a single type, X.509 or JWT
+type authorityManager interface {
+	// name is the authority type used in logs, e.g. "x509"
+	name() string
+	state(ctx context.Context) (*authorityState, error)
+	prepare(ctx context.Context) (*localauthorityv1.AuthorityState, error)
+	activate(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error)
+	taint(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error)
+	revoke(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error)
+	// bundleAuthorities returns the authorities in the bundle, by ID, with
+	// their tainted flag
+	bundleAuthorities(ctx context.Context) (map[string]bool, error)
+}
+
+func newAuthorityManager(authorityType string, conn grpc.ClientConnInterface) (authorityManager, error) {
+	client := localauthorityv1.NewLocalAuthorityClient(conn)
+	bundleClient := bundlev1.NewBundleClient(conn)
+
+	switch authorityType {
+	case "x509":
+		return &x509Authority{client: client, bundleClient: bundleClient}, nil
+	case "jwt":
+		return &jwtAuthority{client: client, bundleClient: bundleClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown authority type %q", authorityType)
+	}
+}
+
+type x509Authority struct {
+	client       localauthorityv1.LocalAuthorityClient
+	bundleClient bundlev1.BundleClient
+}
+
+func (a *x509Authority) name() string {
+	return "x509"
+}
+
+func (a *x509Authority) state(ctx context.Context) (*authorityState, error) {
+	resp, err := a.client.GetX509AuthorityState(ctx, &localauthorityv1.GetX509AuthorityStateRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get X.509 authority state: %w", err)
+	}
+	return &authorityState{active: resp.Active, prepared: resp.Prepared, old: resp.Old}, nil
+}
+
+func (a *x509Authority) prepare(ctx context.Context) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.PrepareX509Authority(ctx, &localauthorityv1.PrepareX509AuthorityRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare X.509 authority: %w", err)
+	}
+	return resp.PreparedAuthority, nil
+}
+
+func (a *x509Authority) activate(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.ActivateX509Authority(ctx, &localauthorityv1.ActivateX509AuthorityRequest{AuthorityId: authorityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate X.509 authority: %w", err)
+	}
+	return resp.ActivatedAuthority, nil
+}
+
+func (a *x509Authority) taint(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.TaintX509Authority(ctx, &localauthorityv1.TaintX509AuthorityRequest{AuthorityId: authorityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to taint X.509 authority: %w", err)
+	}
+	return resp.TaintedAuthority, nil
+}
+
+func (a *x509Authority) revoke(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.RevokeX509Authority(ctx, &localauthorityv1.RevokeX509AuthorityRequest{AuthorityId: authorityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke X.509 authority: %w", err)
+	}
+	return resp.RevokedAuthority, nil
+}
+
+// bundleAuthorities identifies X.509 authorities by subject key ID, which is
+// the authority ID used by the LocalAuthority API
+func (a *x509Authority) bundleAuthorities(ctx context.Context) (map[string]bool, error) {
+	bundle, err := a.bundleClient.GetBundle(ctx, &bundlev1.GetBundleRequest{
+		OutputMask: &types.BundleMask{X509Authorities: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bundle: %w", err)
+	}
+
+	authorities := make(map[string]bool)
+	for _, authority := range bundle.X509Authorities {
+		cert, err := x509.ParseCertificate(authority.Asn1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse X.509 authority: %w", err)
+		}
+		authorities[fmt.Sprintf("%x", cert.SubjectKeyId)] = authority.Tainted
+	}
+	return authorities, nil
+}
+
+type jwtAuthority struct {
+	client       localauthorityv1.LocalAuthorityClient
+	bundleClient bundlev1.BundleClient
+}
+
+func (a *jwtAuthority) name() string {
+	return "jwt"
+}
+
+func (a *jwtAuthority) state(ctx context.Context) (*authorityState, error) {
+	resp, err := a.client.GetJWTAuthorityState(ctx, &localauthorityv1.GetJWTAuthorityStateRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JWT authority state: %w", err)
+	}
+	return &authorityState{active: resp.Active, prepared: resp.Prepared, old: resp.Old}, nil
+}
+
+func (a *jwtAuthority) prepare(ctx context.Context) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.PrepareJWTAuthority(ctx, &localauthorityv1.PrepareJWTAuthorityRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare JWT authority: %w", err)
+	}
+	return resp.PreparedAuthority, nil
+}
+
+func (a *jwtAuthority) activate(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.ActivateJWTAuthority(ctx, &localauthorityv1.ActivateJWTAuthorityRequest{AuthorityId: authorityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate JWT authority: %w", err)
+	}
+	return resp.ActivatedAuthority, nil
+}
+
+func (a *jwtAuthority) taint(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.TaintJWTAuthority(ctx, &localauthorityv1.TaintJWTAuthorityRequest{AuthorityId: authorityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to taint JWT authority: %w", err)
+	}
+	return resp.TaintedAuthority, nil
+}
+
+func (a *jwtAuthority) revoke(ctx context.Context, authorityID string) (*localauthorityv1.AuthorityState, error) {
+	resp, err := a.client.RevokeJWTAuthority(ctx, &localauthorityv1.RevokeJWTAuthorityRequest{AuthorityId: authorityID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke JWT authority: %w", err)
+	}
+	return resp.RevokedAuthority, nil
+}
+
+// bundleAuthorities identifies JWT authorities by key ID
+func (a *jwtAuthority) bundleAuthorities(ctx context.Context) (map[string]bool, error) {
+	bundle, err := a.bundleClient.GetBundle(ctx, &bundlev1.GetBundleRequest{
+		OutputMask: &types.BundleMask{JwtAuthorities: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bundle: %w", err)
+	}
+
+	authorities := make(map[string]bool)
+	for _, authority := range bundle.JwtAuthorities {
+		authorities[authority.KeyId] = authority.Tainted
+	}
+	return authorities, nil
+}
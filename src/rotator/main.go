@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const usage = `Usage: rotator [flags] <command> [authority ID]
+
+Manages SPIRE server local authorities through the server admin socket.
+
+Commands:
+  show      show the authority state and the bundle authorities
+  prepare   prepare a new authority and wait until it is in the bundle
+  activate  activate the prepared authority
+  taint     taint the old authority and wait until it is tainted in the bundle
+  revoke    revoke the old authority and wait until it leaves the bundle,
+            workloads must use the active authority first when configured
+  verify    wait until every workload uses the active authority
+  rotate    run prepare, activate, taint and revoke, waiting between steps
+
+Flags:
+`
+
+var (
+	socketPathFlag    = flag.String("serverSocketPath", "/tmp/spire-server/private/api.sock", "Path to the SPIRE server admin socket")
+	typeFlag          = flag.String("type", "x509", `Authority type: "x509", "jwt" or "all", "all" is only supported by show, verify and rotate`)
+	prepareWaitFlag   = flag.Duration("prepareWait", 30*time.Second, "Time to wait after preparing an authority before activating it")
+	activateWaitFlag  = flag.Duration("activateWait", 30*time.Second, "Time to wait after activating an authority before tainting the old one")
+	taintWaitFlag     = flag.Duration("taintWait", 30*time.Second, "Time to wait after tainting an authority before revoking it")
+	verifyTimeoutFlag = flag.Duration("verifyTimeout", time.Minute, "Maximum time to wait for a step to be visible in the bundle")
+	pollIntervalFlag  = flag.Duration("pollInterval", time.Second, "Interval between bundle and workload checks")
+	workloadsFlag     = flag.String("workloads", "", "Comma separated list of workload status URLs verified before revoking, every address of each host is checked")
+	gateTimeoutFlag   = flag.Duration("gateTimeout", 2*time.Minute, "Maximum time to wait for workloads to use the active authority")
+	log               = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+)
+
+func run() error {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || flag.NArg() > 2 {
+		flag.Usage()
+		return fmt.Errorf("expected a command and an optional authority ID")
+	}
+	command, authorityID := flag.Arg(0), flag.Arg(1)
+
+	types := []string{*typeFlag}
+	if *typeFlag == "all" {
+		if command != "show" && command != "rotate" && command != "verify" {
+			return fmt.Errorf("type %q is not supported by %q", *typeFlag, command)
+		}
+		types = []string{"x509", "jwt"}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, err := grpc.NewClient("unix://"+*socketPathFlag, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to create server client: %w", err)
+	}
+	defer conn.Close()
+
+	config := rotatorConfig{
+		PrepareWait:   *prepareWaitFlag,
+		ActivateWait:  *activateWaitFlag,
+		TaintWait:     *taintWaitFlag,
+		VerifyTimeout: *verifyTimeoutFlag,
+		PollInterval:  *pollIntervalFlag,
+	}
+	var c *collector
+	if *workloadsFlag != "" {
+		c = newCollector(strings.Split(*workloadsFlag, ","), *gateTimeoutFlag, *pollIntervalFlag, log)
+	}
+
+	for _, authorityType := range types {
+		authority, err := newAuthorityManager(strings.ToLower(authorityType), conn)
+		if err != nil {
+			return err
+		}
+		r := newRotator(authority, config, c, log)
+
+		switch command {
+		case "show":
+			err = r.show(ctx)
+		case "prepare":
+			_, err = r.prepare(ctx)
+		case "activate":
+			_, err = r.activate(ctx)
+		case "taint":
+			err = r.taint(ctx, authorityID)
+		case "revoke":
+			err = r.revoke(ctx, authorityID)
+		case "verify":
+			err = r.verifyWorkloads(ctx)
+		case "rotate":
+			err = r.rotate(ctx)
+		default:
+			flag.Usage()
+			return fmt.Errorf("unknown command %q", command)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s failed: %w", authority.name(), command, err)
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Error("Rotator failed", "error", err)
+		os.Exit(1)
+	}
+}
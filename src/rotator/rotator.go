@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	localauthorityv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/localauthority/v1"
+)
+
+// rotatorConfig holds the waits between steps of a full rotation
+type rotatorConfig struct {
+	// Time given to agents and workloads to receive the prepared authority
+	// in their bundle before it is activated
+	PrepareWait time.Duration
+	// Time given to workloads to receive SVIDs signed by the new authority
+	// before the old one is tainted
+	ActivateWait time.Duration
+	// Time given to workloads to replace SVIDs signed by the tainted
+	// authority before it is revoked
+	TaintWait time.Duration
+	// Maximum time to wait for a step to be visible in the bundle
+	VerifyTimeout time.Duration
+	// Interval between bundle checks
+	PollInterval time.Duration
+}
+
+// rotator runs the steps of a local authority rotation and verifies their
+// effect on the authority state and on the bundle
+type rotator struct {
+	authority authorityManager
+	config    rotatorConfig
+	// collector gates revocations, nil when no workloads are configured
+	collector *collector
+	log       *slog.Logger
+}
+
+func newRotator(authority authorityManager, config rotatorConfig, collector *collector, log *slog.Logger) *rotator {
+	return &rotator{
+		authority: authority,
+		config:    config,
+		collector: collector,
+		log:       log.With("type", authority.name()),
+	}
+}
+
+// show logs the current authority state together with the bundle content
+func (r *rotator) show(ctx context.Context) error {
+	state, err := r.authority.state(ctx)
+	if err != nil {
+		return err
+	}
+	bundle, err := r.authority.bundleAuthorities(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.logAuthority("Active authority", state.active)
+	r.logAuthority("Prepared authority", state.prepared)
+	r.logAuthority("Old authority", state.old)
+	for _, id := range slices.Sorted(maps.Keys(bundle)) {
+		r.log.Info("Bundle authority", "authority_id", id, "tainted", bundle[id])
+	}
+	return nil
+}
+
+// rotate runs prepare, activate, taint and revoke, waiting between steps
+func (r *rotator) rotate(ctx context.Context) error {
+	r.log.Info("Starting rotation")
+
+	if _, err := r.prepare(ctx); err != nil {
+		return err
+	}
+	if err := r.wait(ctx, "prepare", r.config.PrepareWait); err != nil {
+		return err
+	}
+
+	old, err := r.activate(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.wait(ctx, "activate", r.config.ActivateWait); err != nil {
+		return err
+	}
+
+	if err := r.taint(ctx, old); err != nil {
+		return err
+	}
+	if err := r.wait(ctx, "taint", r.config.TaintWait); err != nil {
+		return err
+	}
+
+	if err := r.revoke(ctx, old); err != nil {
+		return err
+	}
+
+	r.log.Info("Rotation completed")
+	return nil
+}
+
+// prepare creates a new authority and waits until it is in the bundle
+func (r *rotator) prepare(ctx context.Context) (string, error) {
+	state, err := r.authority.state(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	prepared, err := r.authority.prepare(ctx)
+	if err != nil {
+		return "", err
+	}
+	if prepared.GetAuthorityId() == "" {
+		return "", errors.New("server did not return the prepared authority")
+	}
+	if state.active != nil && prepared.AuthorityId == state.active.AuthorityId {
+		return "", fmt.Errorf("prepared authority %q is the active one", prepared.AuthorityId)
+	}
+	r.logAuthority("Authority prepared", prepared)
+
+	if err := r.waitForBundle(ctx, "prepared authority added to the bundle", func(bundle map[string]bool) bool {
+		_, ok := bundle[prepared.AuthorityId]
+		return ok
+	}); err != nil {
+		return "", err
+	}
+
+	return prepared.AuthorityId, nil
+}
+
+// activate replaces the active authority with the prepared one, it returns
+// the ID of the previously active authority
+func (r *rotator) activate(ctx context.Context) (string, error) {
+	state, err := r.authority.state(ctx)
+	if err != nil {
+		return "", err
+	}
+	if state.prepared == nil {
+		return "", errors.New("there is no prepared authority to activate")
+	}
+	if state.active == nil {
+		return "", errors.New("there is no active authority")
+	}
+	old := state.active.AuthorityId
+
+	activated, err := r.authority.activate(ctx, state.prepared.AuthorityId)
+	if err != nil {
+		return "", err
+	}
+	r.logAuthority("Authority activated", activated)
+
+	state, err = r.authority.state(ctx)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case state.active.GetAuthorityId() != activated.GetAuthorityId():
+		return "", fmt.Errorf("active authority is %q, expected %q", state.active.GetAuthorityId(), activated.GetAuthorityId())
+	case state.old.GetAuthorityId() != old:
+		return "", fmt.Errorf("old authority is %q, expected %q", state.old.GetAuthorityId(), old)
+	}
+
+	return old, nil
+}
+
+// taint marks the old authority as tainted, so workloads replace the SVIDs it
+// signed. When authorityID is empty the current old authority is used.
+func (r *rotator) taint(ctx context.Context, authorityID string) error {
+	authorityID, err := r.oldAuthority(ctx, authorityID)
+	if err != nil {
+		return err
+	}
+
+	tainted, err := r.authority.taint(ctx, authorityID)
+	if err != nil {
+		return err
+	}
+	r.logAuthority("Authority tainted", tainted)
+
+	return r.waitForBundle(ctx, "authority tainted in the bundle", func(bundle map[string]bool) bool {
+		return bundle[authorityID]
+	})
+}
+
+// revoke removes the old authority from the bundle. When authorityID is
+// empty the current old authority is used. If workloads are configured the
+// authority is only revoked once all of them use the active authority.
+func (r *rotator) revoke(ctx context.Context, authorityID string) error {
+	authorityID, err := r.oldAuthority(ctx, authorityID)
+	if err != nil {
+		return err
+	}
+
+	if r.collector != nil {
+		if err := r.verifyWorkloads(ctx); err != nil {
+			return fmt.Errorf("not revoking %q: %w", authorityID, err)
+		}
+	} else {
+		r.log.Warn("No workloads configured, revoking without verification")
+	}
+
+	revoked, err := r.authority.revoke(ctx, authorityID)
+	if err != nil {
+		return err
+	}
+	r.logAuthority("Authority revoked", revoked)
+
+	return r.waitForBundle(ctx, "authority removed from the bundle", func(bundle map[string]bool) bool {
+		_, ok := bundle[authorityID]
+		return !ok
+	})
+}
+
+// verifyWorkloads waits until every workload reports SVIDs signed by the
+// active authority
+func (r *rotator) verifyWorkloads(ctx context.Context) error {
+	if r.collector == nil {
+		return errors.New("no workloads configured")
+	}
+
+	state, err := r.authority.state(ctx)
+	if err != nil {
+		return err
+	}
+	if state.active == nil {
+		return errors.New("there is no active authority")
+	}
+
+	r.log.Info("Verifying workloads", "authority_id", state.active.AuthorityId, "workloads", len(r.collector.workloads))
+	return r.collector.verify(ctx, r.authority.name(), state.active.AuthorityId)
+}
+
+// oldAuthority verifies authorityID is the old authority, or returns the old
+// authority when authorityID is empty
+func (r *rotator) oldAuthority(ctx context.Context, authorityID string) (string, error) {
+	state, err := r.authority.state(ctx)
+	if err != nil {
+		return "", err
+	}
+	if state.old == nil {
+		return "", errors.New("there is no old authority")
+	}
+	if authorityID != "" && authorityID != state.old.AuthorityId {
+		return "", fmt.Errorf("authority %q is not the old authority %q", authorityID, state.old.AuthorityId)
+	}
+	return state.old.AuthorityId, nil
+}
+
+// waitForBundle polls the bundle until done returns true
+func (r *rotator) waitForBundle(ctx context.Context, description string, done func(bundle map[string]bool) bool) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.VerifyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		bundle, err := r.authority.bundleAuthorities(ctx)
+		switch {
+		case err != nil:
+			r.log.Warn("Failed to verify bundle", "error", err)
+		case done(bundle):
+			r.log.Info("Verified", "check", description)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s", description)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *rotator) wait(ctx context.Context, step string, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	r.log.Info("Waiting before next step", "after", step, "duration", d)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (r *rotator) logAuthority(msg string, authority *localauthorityv1.AuthorityState) {
+	if authority == nil {
+		r.log.Info(msg, "authority_id", "")
+		return
+	}
+	r.log.Info(msg, "authority_id", authority.AuthorityId, "expires_at", time.Unix(authority.ExpiresAt, 0).UTC())
+}
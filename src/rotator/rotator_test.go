@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bundlev1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/bundle/v1"
+	localauthorityv1 "github.com/spiffe/spire-api-sdk/proto/spire/api/server/localauthority/v1"
+	"github.com/spiffe/spire-api-sdk/proto/spire/api/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeAuthorities is the local authority state of a single type
+type fakeAuthorities struct {
+	active   *localauthorityv1.AuthorityState
+	prepared *localauthorityv1.AuthorityState
+	old      *localauthorityv1.AuthorityState
+	// bundle holds the authorities in the bundle with their tainted flag
+	bundle map[string]bool
+}
+
+// fakeServer implements the LocalAuthority and Bundle APIs of a SPIRE
+// server, keeping X.509 and JWT authorities apart as the server does
+type fakeServer struct {
+	localauthorityv1.UnimplementedLocalAuthorityServer
+	bundlev1.UnimplementedBundleServer
+
+	t   *testing.T
+	key *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	next  int
+	x509  *fakeAuthorities
+	jwt   *fakeAuthorities
+	certs map[string][]byte
+	// staleBundle stops prepared authorities from reaching the bundle
+	staleBundle bool
+	// keepOld activates authorities without moving the active one to old
+	keepOld bool
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, key: key, certs: make(map[string][]byte)}
+	s.x509 = &fakeAuthorities{bundle: make(map[string]bool)}
+	s.jwt = &fakeAuthorities{bundle: make(map[string]bool)}
+	s.x509.active = s.newAuthority(s.x509)
+	s.jwt.active = s.newAuthority(s.jwt)
+	return s
+}
+
+// newAuthority creates an authority and adds it to the bundle, X.509
+// authority IDs are the subject key ID of their certificate
+func (s *fakeServer) newAuthority(authorities *fakeAuthorities) *localauthorityv1.AuthorityState {
+	s.next++
+	id := fmt.Sprintf("%040x", s.next)
+	if authorities == s.x509 {
+		keyID, _ := hex.DecodeString(id)
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(s.next)),
+			SubjectKeyId:          keyID,
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, s.key.Public(), s.key)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		s.certs[id] = der
+	}
+	if !s.staleBundle {
+		authorities.bundle[id] = false
+	}
+	return &localauthorityv1.AuthorityState{AuthorityId: id, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+}
+
+func (s *fakeServer) prepare(authorities *fakeAuthorities) *localauthorityv1.AuthorityState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authorities.prepared = s.newAuthority(authorities)
+	return authorities.prepared
+}
+
+func (s *fakeServer) activate(authorities *fakeAuthorities, id string) (*localauthorityv1.AuthorityState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if authorities.prepared == nil || authorities.prepared.AuthorityId != id {
+		return nil, status.Errorf(codes.InvalidArgument, "authority %q is not the prepared authority", id)
+	}
+	if !s.keepOld {
+		authorities.old = authorities.active
+	}
+	authorities.active, authorities.prepared = authorities.prepared, nil
+	return authorities.active, nil
+}
+
+func (s *fakeServer) taint(authorities *fakeAuthorities, id string) (*localauthorityv1.AuthorityState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if authorities.old == nil || authorities.old.AuthorityId != id {
+		return nil, status.Errorf(codes.InvalidArgument, "authority %q is not the old authority", id)
+	}
+	authorities.bundle[id] = true
+	return authorities.old, nil
+}
+
+func (s *fakeServer) revoke(authorities *fakeAuthorities, id string) (*localauthorityv1.AuthorityState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if authorities.old == nil || authorities.old.AuthorityId != id {
+		return nil, status.Errorf(codes.InvalidArgument, "authority %q is not the old authority", id)
+	}
+	if !authorities.bundle[id] {
+		return nil, status.Errorf(codes.FailedPrecondition, "authority %q is not tainted", id)
+	}
+	delete(authorities.bundle, id)
+	revoked := authorities.old
+	authorities.old = nil
+	return revoked, nil
+}
+
+func (s *fakeServer) GetX509AuthorityState(context.Context, *localauthorityv1.GetX509AuthorityStateRequest) (*localauthorityv1.GetX509AuthorityStateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &localauthorityv1.GetX509AuthorityStateResponse{Active: s.x509.active, Prepared: s.x509.prepared, Old: s.x509.old}, nil
+}
+
+func (s *fakeServer) PrepareX509Authority(context.Context, *localauthorityv1.PrepareX509AuthorityRequest) (*localauthorityv1.PrepareX509AuthorityResponse, error) {
+	return &localauthorityv1.PrepareX509AuthorityResponse{PreparedAuthority: s.prepare(s.x509)}, nil
+}
+
+func (s *fakeServer) ActivateX509Authority(_ context.Context, req *localauthorityv1.ActivateX509AuthorityRequest) (*localauthorityv1.ActivateX509AuthorityResponse, error) {
+	activated, err := s.activate(s.x509, req.AuthorityId)
+	if err != nil {
+		return nil, err
+	}
+	return &localauthorityv1.ActivateX509AuthorityResponse{ActivatedAuthority: activated}, nil
+}
+
+func (s *fakeServer) TaintX509Authority(_ context.Context, req *localauthorityv1.TaintX509AuthorityRequest) (*localauthorityv1.TaintX509AuthorityResponse, error) {
+	tainted, err := s.taint(s.x509, req.AuthorityId)
+	if err != nil {
+		return nil, err
+	}
+	return &localauthorityv1.TaintX509AuthorityResponse{TaintedAuthority: tainted}, nil
+}
+
+func (s *fakeServer) RevokeX509Authority(_ context.Context, req *localauthorityv1.RevokeX509AuthorityRequest) (*localauthorityv1.RevokeX509AuthorityResponse, error) {
+	revoked, err := s.revoke(s.x509, req.AuthorityId)
+	if err != nil {
+		return nil, err
+	}
+	return &localauthorityv1.RevokeX509AuthorityResponse{RevokedAuthority: revoked}, nil
+}
+
+func (s *fakeServer) GetJWTAuthorityState(context.Context, *localauthorityv1.GetJWTAuthorityStateRequest) (*localauthorityv1.GetJWTAuthorityStateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &localauthorityv1.GetJWTAuthorityStateResponse{Active: s.jwt.active, Prepared: s.jwt.prepared, Old: s.jwt.old}, nil
+}
+
+func (s *fakeServer) PrepareJWTAuthority(context.Context, *localauthorityv1.PrepareJWTAuthorityRequest) (*localauthorityv1.PrepareJWTAuthorityResponse, error) {
+	return &localauthorityv1.PrepareJWTAuthorityResponse{PreparedAuthority: s.prepare(s.jwt)}, nil
+}
+
+func (s *fakeServer) ActivateJWTAuthority(_ context.Context, req *localauthorityv1.ActivateJWTAuthorityRequest) (*localauthorityv1.ActivateJWTAuthorityResponse, error) {
+	activated, err := s.activate(s.jwt, req.AuthorityId)
+	if err != nil {
+		return nil, err
+	}
+	return &localauthorityv1.ActivateJWTAuthorityResponse{ActivatedAuthority: activated}, nil
+}
+
+func (s *fakeServer) TaintJWTAuthority(_ context.Context, req *localauthorityv1.TaintJWTAuthorityRequest) (*localauthorityv1.TaintJWTAuthorityResponse, error) {
+	tainted, err := s.taint(s.jwt, req.AuthorityId)
+	if err != nil {
+		return nil, err
+	}
+	return &localauthorityv1.TaintJWTAuthorityResponse{TaintedAuthority: tainted}, nil
+}
+
+func (s *fakeServer) RevokeJWTAuthority(_ context.Context, req *localauthorityv1.RevokeJWTAuthorityRequest) (*localauthorityv1.RevokeJWTAuthorityResponse, error) {
+	revoked, err := s.revoke(s.jwt, req.AuthorityId)
+	if err != nil {
+		return nil, err
+	}
+	return &localauthorityv1.RevokeJWTAuthorityResponse{RevokedAuthority: revoked}, nil
+}
+
+func (s *fakeServer) GetBundle(_ context.Context, req *bundlev1.GetBundleRequest) (*types.Bundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bundle := &types.Bundle{TrustDomain: "cluster.demo"}
+	if req.OutputMask.GetX509Authorities() {
+		for id, tainted := range s.x509.bundle {
+			bundle.X509Authorities = append(bundle.X509Authorities, &types.X509Certificate{Asn1: s.certs[id], Tainted: tainted})
+		}
+	}
+	if req.OutputMask.GetJwtAuthorities() {
+		for id, tainted := range s.jwt.bundle {
+			bundle.JwtAuthorities = append(bundle.JwtAuthorities, &types.JWTKey{KeyId: id, Tainted: tainted})
+		}
+	}
+	return bundle, nil
+}
+
+func (s *fakeServer) authorities(authorityType string) *fakeAuthorities {
+	if authorityType == "x509" {
+		return s.x509
+	}
+	return s.jwt
+}
+
+// snapshot returns the state and bundle of an authority type
+func (s *fakeServer) snapshot(authorityType string) fakeAuthorities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authorities := *s.authorities(authorityType)
+	authorities.bundle = make(map[string]bool)
+	for id, tainted := range s.authorities(authorityType).bundle {
+		authorities.bundle[id] = tainted
+	}
+	return authorities
+}
+
+// serve runs the fake server on an in-memory listener and returns a client
+// connection to it
+func (s *fakeServer) serve(t *testing.T) grpc.ClientConnInterface {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	localauthorityv1.RegisterLocalAuthorityServer(server, s)
+	bundlev1.RegisterBundleServer(server, s)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestRotator(t *testing.T, server *fakeServer, authorityType string) *rotator {
+	authority, err := newAuthorityManager(authorityType, server.serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := rotatorConfig{VerifyTimeout: 200 * time.Millisecond, PollInterval: 10 * time.Millisecond}
+	return newRotator(authority, config, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestRotatorSteps(t *testing.T) {
+	for _, authorityType := range []string{"x509", "jwt"} {
+		t.Run(authorityType, func(t *testing.T) {
+			ctx := context.Background()
+			server := newFakeServer(t)
+			r := newTestRotator(t, server, authorityType)
+			initial := server.snapshot(authorityType).active.AuthorityId
+
+			prepared, err := r.prepare(ctx)
+			if err != nil {
+				t.Fatalf("prepare failed: %v", err)
+			}
+			state := server.snapshot(authorityType)
+			if state.prepared.GetAuthorityId() != prepared {
+				t.Fatalf("prepared authority = %q, want %q", state.prepared.GetAuthorityId(), prepared)
+			}
+			if _, ok := state.bundle[prepared]; !ok {
+				t.Fatalf("prepared authority %q is not in the bundle", prepared)
+			}
+
+			old, err := r.activate(ctx)
+			if err != nil {
+				t.Fatalf("activate failed: %v", err)
+			}
+			if old != initial {
+				t.Fatalf("activate returned old authority %q, want %q", old, initial)
+			}
+			state = server.snapshot(authorityType)
+			if state.active.GetAuthorityId() != prepared || state.old.GetAuthorityId() != initial {
+				t.Fatalf("active = %q, old = %q, want %q and %q",
+					state.active.GetAuthorityId(), state.old.GetAuthorityId(), prepared, initial)
+			}
+
+			// An empty ID selects the old authority
+			if err := r.taint(ctx, ""); err != nil {
+				t.Fatalf("taint failed: %v", err)
+			}
+			if state := server.snapshot(authorityType); !state.bundle[initial] {
+				t.Fatalf("authority %q is not tainted in the bundle", initial)
+			}
+
+			if err := r.revoke(ctx, initial); err != nil {
+				t.Fatalf("revoke failed: %v", err)
+			}
+			state = server.snapshot(authorityType)
+			if _, ok := state.bundle[initial]; ok {
+				t.Fatalf("revoked authority %q is still in the bundle", initial)
+			}
+			if state.old != nil {
+				t.Fatalf("old authority = %q, want none", state.old.AuthorityId)
+			}
+		})
+	}
+}
+
+func TestRotatorRotate(t *testing.T) {
+	for _, authorityType := range []string{"x509", "jwt"} {
+		t.Run(authorityType, func(t *testing.T) {
+			server := newFakeServer(t)
+			r := newTestRotator(t, server, authorityType)
+			initial := server.snapshot(authorityType).active.AuthorityId
+
+			if err := r.rotate(context.Background()); err != nil {
+				t.Fatalf("rotate failed: %v", err)
+			}
+
+			state := server.snapshot(authorityType)
+			active := state.active.GetAuthorityId()
+			if active == initial {
+				t.Fatalf("active authority is still %q", initial)
+			}
+			if len(state.bundle) != 1 || state.bundle[active] {
+				t.Fatalf("bundle = %v, want only the untainted active authority %q", state.bundle, active)
+			}
+			// The other authority type is not rotated
+			other := "jwt"
+			if authorityType == "jwt" {
+				other = "x509"
+			}
+			if state := server.snapshot(other); state.old != nil || state.prepared != nil {
+				t.Fatalf("%s authorities changed by a %s rotation", other, authorityType)
+			}
+		})
+	}
+}
+
+func TestRotatorFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(ctx context.Context, t *testing.T, server *fakeServer, r *rotator)
+		step    func(ctx context.Context, r *rotator) error
+		wantErr string
+	}{
+		{
+			name:    "activate without prepared authority",
+			step:    func(ctx context.Context, r *rotator) error { _, err := r.activate(ctx); return err },
+			wantErr: "there is no prepared authority to activate",
+		},
+		{
+			name: "activate state mismatch",
+			setup: func(_ context.Context, _ *testing.T, server *fakeServer, r *rotator) {
+				server.prepare(server.authorities(r.authority.name()))
+				server.keepOld = true
+			},
+			step:    func(ctx context.Context, r *rotator) error { _, err := r.activate(ctx); return err },
+			wantErr: `old authority is "", expected`,
+		},
+		{
+			name:    "taint without old authority",
+			step:    func(ctx context.Context, r *rotator) error { return r.taint(ctx, "") },
+			wantErr: "there is no old authority",
+		},
+		{
+			name: "taint wrong authority",
+			setup: func(ctx context.Context, t *testing.T, _ *fakeServer, r *rotator) {
+				if _, err := r.prepare(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := r.activate(ctx); err != nil {
+					t.Fatal(err)
+				}
+			},
+			step:    func(ctx context.Context, r *rotator) error { return r.taint(ctx, "unknown") },
+			wantErr: `authority "unknown" is not the old authority`,
+		},
+		{
+			name: "revoke wrong authority",
+			setup: func(ctx context.Context, t *testing.T, _ *fakeServer, r *rotator) {
+				if _, err := r.prepare(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := r.activate(ctx); err != nil {
+					t.Fatal(err)
+				}
+			},
+			step:    func(ctx context.Context, r *rotator) error { return r.revoke(ctx, "unknown") },
+			wantErr: `authority "unknown" is not the old authority`,
+		},
+		{
+			name: "revoke rejected by the server",
+			setup: func(ctx context.Context, t *testing.T, _ *fakeServer, r *rotator) {
+				if _, err := r.prepare(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := r.activate(ctx); err != nil {
+					t.Fatal(err)
+				}
+			},
+			step:    func(ctx context.Context, r *rotator) error { return r.revoke(ctx, "") },
+			wantErr: "failed to revoke",
+		},
+		{
+			name: "prepared authority never reaches the bundle",
+			setup: func(_ context.Context, _ *testing.T, server *fakeServer, _ *rotator) {
+				server.staleBundle = true
+			},
+			step:    func(ctx context.Context, r *rotator) error { _, err := r.prepare(ctx); return err },
+			wantErr: "timed out waiting for prepared authority added to the bundle",
+		},
+		{
+			name: "rotate stops at the failed step",
+			setup: func(_ context.Context, _ *testing.T, server *fakeServer, _ *rotator) {
+				server.staleBundle = true
+			},
+			step:    func(ctx context.Context, r *rotator) error { return r.rotate(ctx) },
+			wantErr: "timed out waiting for prepared authority added to the bundle",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, authorityType := range []string{"x509", "jwt"} {
+			t.Run(tt.name+"/"+authorityType, func(t *testing.T) {
+				ctx := context.Background()
+				server := newFakeServer(t)
+				r := newTestRotator(t, server, authorityType)
+				if tt.setup != nil {
+					tt.setup(ctx, t, server, r)
+				}
+				before := server.snapshot(authorityType)
+
+				err := tt.step(ctx, r)
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				// Failed checks never change which authority is active
+				if tt.name != "activate state mismatch" {
+					if after := server.snapshot(authorityType); after.active.GetAuthorityId() != before.active.GetAuthorityId() {
+						t.Fatalf("active authority changed from %q to %q", before.active.GetAuthorityId(), after.active.GetAuthorityId())
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// workloadStatus is the part of the workload status endpoint used by the
+// collector, see rotation.TaintStatus
+type workloadStatus struct {
+	X509 *struct {
+		SPIFFEID       string `json:"spiffe_id"`
+		AuthorityKeyID string `json:"authority_key_id"`
+	} `json:"x509"`
+	JWT *struct {
+		SPIFFEID       string `json:"spiffe_id"`
+		AuthorityKeyID string `json:"authority_key_id"`
+	} `json:"jwt"`
+	Verification *struct {
+		Passed bool   `json:"passed"`
+		Reason string `json:"reason"`
+	} `json:"verification"`
+}
+
+// workloadResult is the verification result of a workload endpoint
+type workloadResult struct {
+	// workload is the configured status URL and url the endpoint checked
+	workload  string
+	url       string
+	spiffeID  string
+	authority string
+	passed    bool
+	reason    string
+}
+
+// resolver looks up the addresses of a host, it is implemented by
+// net.Resolver
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// collector polls the status endpoint of every workload until all of them
+// report SVIDs signed by the expected authority. The host of each workload
+// URL is resolved on every poll and each address is checked, so when it
+// names a headless Service every pod behind it is verified.
+type collector struct {
+	workloads    []string
+	timeout      time.Duration
+	pollInterval time.Duration
+	resolver     resolver
+	client       *http.Client
+	log          *slog.Logger
+}
+
+func newCollector(workloads []string, timeout, pollInterval time.Duration, log *slog.Logger) *collector {
+	return &collector{
+		workloads:    workloads,
+		timeout:      timeout,
+		pollInterval: pollInterval,
+		resolver:     net.DefaultResolver,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		log:          log,
+	}
+}
+
+// verify blocks until every workload endpoint reports authorityID for
+// authorityType, "x509" or "jwt", or the timeout expires. Every endpoint is
+// checked again on each poll, since pods may be replaced while waiting. A
+// report is logged in both cases and an error is returned if any endpoint
+// did not move to authorityID.
+func (c *collector) verify(ctx context.Context, authorityType, authorityID string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	results := c.checkAll(ctx, authorityType, authorityID)
+	for {
+		failed := 0
+		for _, result := range results {
+			if !result.passed {
+				failed++
+			}
+		}
+		if failed == 0 {
+			c.report(authorityType, authorityID, results)
+			return nil
+		}
+
+		timeout := fmt.Errorf("%d of %d workload endpoints did not move to authority %q", failed, len(results), authorityID)
+		select {
+		case <-ctx.Done():
+			c.report(authorityType, authorityID, results)
+			return timeout
+		case <-ticker.C:
+		}
+
+		next := c.checkAll(ctx, authorityType, authorityID)
+		if ctx.Err() != nil {
+			// The poll was interrupted, the previous one is reported
+			c.report(authorityType, authorityID, results)
+			return timeout
+		}
+		results = next
+	}
+}
+
+// checkAll checks the endpoints of every workload
+func (c *collector) checkAll(ctx context.Context, authorityType, authorityID string) []*workloadResult {
+	var results []*workloadResult
+	for _, workload := range c.workloads {
+		results = append(results, c.checkWorkload(ctx, workload, authorityType, authorityID)...)
+	}
+	return results
+}
+
+// checkWorkload checks every address the workload host resolves to
+func (c *collector) checkWorkload(ctx context.Context, workload, authorityType, authorityID string) []*workloadResult {
+	u, err := url.Parse(workload)
+	if err != nil {
+		return []*workloadResult{{workload: workload, url: workload, reason: fmt.Sprintf("invalid URL: %v", err)}}
+	}
+	addrs, err := c.resolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		return []*workloadResult{{workload: workload, url: workload, reason: fmt.Sprintf("failed to resolve host: %v", err)}}
+	}
+	slices.Sort(addrs)
+
+	var results []*workloadResult
+	for _, addr := range addrs {
+		endpoint := *u
+		endpoint.Host = addr
+		if port := u.Port(); port != "" {
+			endpoint.Host = net.JoinHostPort(addr, port)
+		} else if strings.Contains(addr, ":") {
+			endpoint.Host = "[" + addr + "]"
+		}
+		result := c.check(ctx, endpoint.String(), authorityType, authorityID)
+		result.workload = workload
+		results = append(results, result)
+	}
+	return results
+}
+
+func (c *collector) check(ctx context.Context, workload, authorityType, authorityID string) *workloadResult {
+	result := &workloadResult{url: workload}
+
+	u, err := url.Parse(workload)
+	if err != nil {
+		result.reason = fmt.Sprintf("invalid URL: %v", err)
+		return result
+	}
+	query := u.Query()
+	query.Set(authorityType+"_authority", authorityID)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		result.reason = fmt.Sprintf("failed to create request: %v", err)
+		return result
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		result.reason = fmt.Sprintf("request failed: %v", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPreconditionFailed {
+		result.reason = fmt.Sprintf("unexpected status code: %d", resp.StatusCode)
+		return result
+	}
+	var status workloadStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		result.reason = fmt.Sprintf("failed to decode status: %v", err)
+		return result
+	}
+
+	switch {
+	case authorityType == "x509" && status.X509 != nil:
+		result.spiffeID, result.authority = status.X509.SPIFFEID, status.X509.AuthorityKeyID
+	case authorityType == "jwt" && status.JWT != nil:
+		result.spiffeID, result.authority = status.JWT.SPIFFEID, status.JWT.AuthorityKeyID
+	}
+	if status.Verification == nil {
+		result.reason = "workload does not support verification"
+		return result
+	}
+	result.passed = status.Verification.Passed
+	result.reason = status.Verification.Reason
+	return result
+}
+
+// report logs the result of every workload endpoint
+func (c *collector) report(authorityType, authorityID string, results []*workloadResult) {
+	failed := 0
+	for _, result := range results {
+		if result.passed {
+			c.log.Info("Workload verification passed", "type", authorityType, "workload", result.workload,
+				"endpoint", result.url, "spiffe_id", result.spiffeID, "authority_id", result.authority)
+			continue
+		}
+		failed++
+		c.log.Error("Workload verification failed", "type", authorityType, "workload", result.workload,
+			"endpoint", result.url, "spiffe_id", result.spiffeID, "authority_id", result.authority,
+			"reason", result.reason)
+	}
+
+	if failed == 0 {
+		c.log.Info("Verification passed", "type", authorityType, "authority_id", authorityID, "endpoints", len(results))
+	} else {
+		c.log.Error("Verification failed", "type", authorityType, "authority_id", authorityID,
+			"endpoints", len(results), "failed", failed)
+	}
+}
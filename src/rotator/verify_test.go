@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeWorkload serves a status endpoint that reports the authority in
+// authority, verification is omitted when unsupported is set
+func fakeWorkload(t *testing.T, authority *atomic.Value, unsupported bool) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current := authority.Load().(string)
+		expected := req.URL.Query().Get("x509_authority")
+
+		status := map[string]any{
+			"x509": map[string]string{
+				"spiffe_id":        "spiffe://cluster.demo/ns/api-ns/sa/default",
+				"authority_key_id": current,
+			},
+		}
+		code := http.StatusOK
+		if !unsupported {
+			passed := current == expected
+			reason := ""
+			if !passed {
+				reason = "X509-SVID is signed by " + current
+				code = http.StatusPreconditionFailed
+			}
+			status["verification"] = map[string]any{"passed": passed, "reason": reason}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestCollector(timeout time.Duration, workloads ...string) *collector {
+	return newCollector(workloads, timeout, 10*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestCollectorCheck(t *testing.T) {
+	var authority atomic.Value
+	authority.Store("old")
+	workload := fakeWorkload(t, &authority, false)
+	unsupported := fakeWorkload(t, &authority, true)
+
+	tests := []struct {
+		name          string
+		url           string
+		authorityID   string
+		wantPassed    bool
+		wantAuthority string
+		wantReason    string
+	}{
+		{
+			name:          "passed",
+			url:           workload.URL + "/status/authority",
+			authorityID:   "old",
+			wantPassed:    true,
+			wantAuthority: "old",
+		},
+		{
+			name:          "precondition failed",
+			url:           workload.URL + "/status/authority",
+			authorityID:   "new",
+			wantAuthority: "old",
+			wantReason:    "X509-SVID is signed by old",
+		},
+		{
+			name:          "verification not supported",
+			url:           unsupported.URL + "/status/authority",
+			authorityID:   "old",
+			wantAuthority: "old",
+			wantReason:    "workload does not support verification",
+		},
+	}
+
+	c := newTestCollector(time.Second)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := c.check(context.Background(), tt.url, "x509", tt.authorityID)
+			if result.passed != tt.wantPassed {
+				t.Errorf("passed = %v, want %v", result.passed, tt.wantPassed)
+			}
+			if result.authority != tt.wantAuthority {
+				t.Errorf("authority = %q, want %q", result.authority, tt.wantAuthority)
+			}
+			if result.reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", result.reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestCollectorVerify(t *testing.T) {
+	var authority atomic.Value
+	authority.Store("old")
+	workload := fakeWorkload(t, &authority, false)
+
+	t.Run("passed", func(t *testing.T) {
+		c := newTestCollector(5*time.Second, workload.URL)
+		if err := c.verify(context.Background(), "x509", "old"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("passed after moving to the authority", func(t *testing.T) {
+		authority.Store("old")
+		time.AfterFunc(50*time.Millisecond, func() { authority.Store("new") })
+		c := newTestCollector(5*time.Second, workload.URL)
+		if err := c.verify(context.Background(), "x509", "new"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("precondition failed until timeout", func(t *testing.T) {
+		authority.Store("old")
+		c := newTestCollector(100*time.Millisecond, workload.URL)
+		start := time.Now()
+		err := c.verify(context.Background(), "x509", "new")
+		if err == nil || !strings.Contains(err.Error(), `1 of 1 workload endpoints did not move to authority "new"`) {
+			t.Fatalf("error = %v, want 1 of 1 workloads did not move", err)
+		}
+		if elapsed := time.Since(start); elapsed < c.timeout {
+			t.Fatalf("verify returned after %v, before the timeout", elapsed)
+		}
+	})
+
+	t.Run("verification not supported", func(t *testing.T) {
+		authority.Store("old")
+		unsupported := fakeWorkload(t, &authority, true)
+		c := newTestCollector(100*time.Millisecond, workload.URL, unsupported.URL)
+		err := c.verify(context.Background(), "x509", "old")
+		if err == nil || !strings.Contains(err.Error(), "1 of 2 workload endpoints") {
+			t.Fatalf("error = %v, want 1 of 2 workloads did not move", err)
+		}
+	})
+}
+
+// fakeResolver resolves hosts to the addresses of a headless Service
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return slices.Clone(addrs), nil
+}
+
+// TestCollectorVerifyReplicas verifies every pod behind a workload URL is
+// checked on each poll
+func TestCollectorVerifyReplicas(t *testing.T) {
+	var first, second atomic.Value
+	// Pod addresses are routed to the fake workloads
+	pods := map[string]string{
+		"10.0.0.1:9002": fakeWorkload(t, &first, false).Listener.Addr().String(),
+		"10.0.0.2:9002": fakeWorkload(t, &second, false).Listener.Addr().String(),
+	}
+	newReplicasCollector := func(timeout time.Duration, resolver fakeResolver) *collector {
+		c := newTestCollector(timeout, "http://api-admin.api-ns.svc.cluster.local:9002/status/authority")
+		c.resolver = resolver
+		c.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, pods[addr])
+			},
+		}}
+		return c
+	}
+	replicas := fakeResolver{"api-admin.api-ns.svc.cluster.local": {"10.0.0.2", "10.0.0.1"}}
+
+	t.Run("one replica on the old authority", func(t *testing.T) {
+		first.Store("new")
+		second.Store("old")
+		c := newReplicasCollector(100*time.Millisecond, replicas)
+		err := c.verify(context.Background(), "x509", "new")
+		if err == nil || !strings.Contains(err.Error(), "1 of 2 workload endpoints") {
+			t.Fatalf("error = %v, want 1 of 2 workload endpoints did not move", err)
+		}
+	})
+
+	t.Run("every replica checked", func(t *testing.T) {
+		first.Store("new")
+		second.Store("old")
+		c := newReplicasCollector(100*time.Millisecond, replicas)
+		results := c.checkWorkload(context.Background(), c.workloads[0], "x509", "new")
+		var endpoints []string
+		for _, result := range results {
+			endpoints = append(endpoints, result.url)
+		}
+		want := []string{"http://10.0.0.1:9002/status/authority", "http://10.0.0.2:9002/status/authority"}
+		if !slices.Equal(endpoints, want) {
+			t.Fatalf("endpoints = %v, want %v", endpoints, want)
+		}
+		if !results[0].passed || results[1].passed {
+			t.Fatalf("passed = %v, %v, want true, false", results[0].passed, results[1].passed)
+		}
+	})
+
+	t.Run("passed after every replica moved", func(t *testing.T) {
+		first.Store("new")
+		second.Store("old")
+		time.AfterFunc(50*time.Millisecond, func() { second.Store("new") })
+		c := newReplicasCollector(5*time.Second, replicas)
+		if err := c.verify(context.Background(), "x509", "new"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("passed replica checked again", func(t *testing.T) {
+		// The first replica moves back after passing once, e.g. it was
+		// replaced by a pod that started with an old SVID
+		first.Store("new")
+		second.Store("old")
+		time.AfterFunc(20*time.Millisecond, func() { first.Store("old") })
+		time.AfterFunc(50*time.Millisecond, func() { second.Store("new") })
+		c := newReplicasCollector(200*time.Millisecond, replicas)
+		err := c.verify(context.Background(), "x509", "new")
+		if err == nil || !strings.Contains(err.Error(), "1 of 2 workload endpoints") {
+			t.Fatalf("error = %v, want 1 of 2 workload endpoints did not move", err)
+		}
+	})
+
+	t.Run("host not resolved", func(t *testing.T) {
+		c := newReplicasCollector(100*time.Millisecond, fakeResolver{})
+		err := c.verify(context.Background(), "x509", "new")
+		if err == nil || !strings.Contains(err.Error(), "1 of 1 workload endpoints") {
+			t.Fatalf("error = %v, want 1 of 1 workload endpoints did not move", err)
+		}
+	})
+}